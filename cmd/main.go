@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
+	"github.com/grindlemire/gothem-stack/pkg/lifecycle"
 	"github.com/grindlemire/gothem-stack/pkg/log"
 	"github.com/grindlemire/gothem-stack/pkg/server"
+	"github.com/grindlemire/gothem-stack/pkg/tracing"
 
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
@@ -25,19 +28,29 @@ func main() {
 		Name:  "serve",
 		Usage: "serve an htmx api",
 		Action: func(c *cli.Context) (err error) {
-			ctx, cancel := context.WithCancel(c.Context)
+			// cancel the context on SIGINT (ctrl-c) locally and SIGTERM which is what
+			// Cloud Run and Docker send when stopping the container
+			ctx, cancel := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
 			defer cancel()
 
-			// Create a signal channel
-			sigCh := make(chan os.Signal, 1)
-			// Register a signal handler for SIGINT
-			signal.Notify(sigCh, os.Interrupt)
+			// components are started in the order they are registered and stopped in reverse
+			lc := lifecycle.New()
 
-			go func() {
-				<-sigCh
-				cancel()
-			}()
-			return server.Run(ctx)
+			// tracing is registered first so it is stopped last and flushes the spans of the
+			// final requests
+			tp, err := tracing.New(ctx)
+			if err != nil {
+				return err
+			}
+			tp.Register(lc)
+
+			srv, err := server.New(ctx)
+			if err != nil {
+				return err
+			}
+			srv.Register(lc)
+
+			return lc.Run(ctx)
 		},
 	}
 
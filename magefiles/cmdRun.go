@@ -54,6 +54,7 @@ func run(ctx context.Context) error {
 			"air",
 			"-c", ".air.toml",
 		),
+		cmd.WithEnv("DEV_ERROR_PAGES=true", "DEV_MAIL=true"),
 	)
 	if err != nil {
 		zap.S().Errorf("Error running air server: %v", err)
@@ -0,0 +1,475 @@
+// Package accounts is first party sign in with an email and password. It handles signing up,
+// verifying emails, signing in and out with sessions, resetting passwords and locking accounts
+// after repeated failed sign ins. Users and tokens are persisted through a Store.
+package accounts
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// SessionCookie is the name of the cookie holding the session token
+	SessionCookie = "session"
+
+	verifyTTL = 24 * time.Hour
+	resetTTL  = time.Hour
+	// verifyResendInterval is how long signing in to an unverified account waits before sending
+	// another verification email, so signing in can't be used to flood the inbox
+	verifyResendInterval = 10 * time.Minute
+
+	minPasswordLength = 10
+	// maxPasswordLength stops huge passwords from being used to burn cpu on hashing
+	maxPasswordLength = 256
+)
+
+// User is an account. Local users sign in with their email and password, external users through
+// an identity provider.
+type User struct {
+	ID           string
+	Email        string
+	Name         string
+	PasswordHash string
+	Roles        []string
+	Verified     bool
+	CreatedAt    time.Time
+	// VerificationSentAt is when the last verification email was sent
+	VerificationSentAt time.Time
+
+	// FailedLogins counts the failed sign ins since the last successful one. The account is
+	// locked until LockedUntil once it reaches the limit.
+	FailedLogins int
+	LockedUntil  time.Time
+}
+
+// Principal is the user as the principal of a request
+func (u User) Principal() *auth.Principal {
+	return &auth.Principal{ID: u.ID, Name: u.Name, Roles: u.Roles, AllScopes: true, Method: auth.MethodSession}
+}
+
+func (u User) copy() User {
+	u.Roles = append([]string(nil), u.Roles...)
+	return u
+}
+
+// Config configures the accounts service
+type Config struct {
+	// BaseURL is the public url of the site used for the links in emails. It is never taken from
+	// the request so a forged Host header can't redirect reset links elsewhere.
+	BaseURL string
+	// SessionTTL is how long a session lasts after signing in
+	SessionTTL time.Duration
+	// MaxFailedLogins is how many failed sign ins in a row lock the account for LockoutDuration
+	MaxFailedLogins int
+	LockoutDuration time.Duration
+	// PasswordParams are the argon2id parameters new hashes are created with
+	PasswordParams PasswordParams
+}
+
+// Service implements the account flows
+type Service struct {
+	store  Store
+	mailer Mailer
+	config Config
+
+	// dummyHash is verified against when the email is unknown so the response time doesn't
+	// reveal which emails have accounts
+	dummyHash string
+}
+
+// NewService creates the accounts service
+func NewService(store Store, mailer Mailer, config Config) (s *Service, err error) {
+	dummyHash, err := HashPassword(uuid.NewString(), config.PasswordParams)
+	if err != nil {
+		return s, err
+	}
+	return &Service{
+		store:     store,
+		mailer:    mailer,
+		config:    config,
+		dummyHash: dummyHash,
+	}, nil
+}
+
+// Signup creates an unverified account and emails a verification link. Signing up with an email
+// that already has an account looks the same to the caller, the owner is emailed instead so
+// signing up can't be used to find out who has an account.
+func (s *Service) Signup(ctx context.Context, name, email, password string) error {
+	name = strings.TrimSpace(name)
+	email = strings.TrimSpace(email)
+
+	ae := apperr.New(apperr.CodeInvalidArgument, "Check the highlighted fields")
+	if name == "" {
+		ae.WithField("name", "Enter your name")
+	}
+	if msg := validateEmail(email); msg != "" {
+		ae.WithField("email", msg)
+	}
+	if msg := validatePassword(password); msg != "" {
+		ae.WithField("password", msg)
+	}
+	if len(ae.Fields) > 0 {
+		return ae
+	}
+
+	hash, err := HashPassword(password, s.config.PasswordParams)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	u := User{
+		ID:                 uuid.NewString(),
+		Email:              email,
+		Name:               name,
+		PasswordHash:       hash,
+		CreatedAt:          now,
+		VerificationSentAt: now,
+	}
+	err = s.store.CreateUser(ctx, u)
+	if errors.Is(err, ErrEmailTaken) {
+		existing, err := s.store.UserByEmail(ctx, email)
+		if err != nil {
+			return errors.Wrap(err, "loading existing user")
+		}
+		return s.mailer.Send(ctx, Message{
+			To:      existing.Email,
+			Subject: "You already have an account",
+			Body: fmt.Sprintf("Someone tried to sign up with your email. If it was you, sign in or reset your password:\n\n%s/forgot-password\n\nOtherwise you can ignore this email.",
+				s.config.BaseURL),
+		})
+	}
+	if err != nil {
+		return errors.Wrap(err, "creating user")
+	}
+
+	log.FromContext(ctx).Info("user signed up", zap.String("user_id", u.ID))
+	return s.sendVerification(ctx, u)
+}
+
+// CheckVerifyToken reports whether the verification token can still be used without using it up.
+// Mail scanners open links before the user does, so only Verify takes the token.
+func (s *Service) CheckVerifyToken(ctx context.Context, token string) error {
+	return s.checkToken(ctx, token, PurposeVerify)
+}
+
+// Verify marks the email of the user the token was issued to as verified
+func (s *Service) Verify(ctx context.Context, token string) (User, error) {
+	t, err := s.takeToken(ctx, token, PurposeVerify)
+	if err != nil {
+		return User{}, err
+	}
+
+	u, err := s.store.UserByID(ctx, t.UserID)
+	if err != nil {
+		return User{}, errors.Wrap(err, "loading user")
+	}
+	u.Verified = true
+	err = s.store.UpdateUser(ctx, u)
+	if err != nil {
+		return User{}, errors.Wrap(err, "updating user")
+	}
+	return u, nil
+}
+
+// Login checks the email and password and starts a session. The returned token goes in the
+// SessionCookie. Accounts are locked for a while after too many failed attempts in a row. A locked
+// account looks the same as a wrong password unless the password is right, so locking can't be
+// used to find out who has an account.
+func (s *Service) Login(ctx context.Context, email, password string) (token string, u User, err error) {
+	wrong := apperr.New(apperr.CodeUnauthenticated, "Wrong email or password")
+
+	u, err = s.store.UserByEmail(ctx, strings.TrimSpace(email))
+	if errors.Is(err, ErrNotFound) {
+		_, _ = VerifyPassword(s.dummyHash, password)
+		return "", u, wrong
+	}
+	if err != nil {
+		return "", u, errors.Wrap(err, "loading user")
+	}
+
+	locked := time.Now().Before(u.LockedUntil)
+	match, err := VerifyPassword(u.PasswordHash, password)
+	if err != nil {
+		return "", u, err
+	}
+	if !match {
+		// guesses while the account is locked don't extend the lock
+		if locked {
+			return "", u, wrong
+		}
+		lockedNow, err := s.store.IncrementFailedLogins(ctx, u.ID, s.config.MaxFailedLogins, time.Now().Add(s.config.LockoutDuration))
+		if err != nil {
+			return "", u, errors.Wrap(err, "recording failed sign in")
+		}
+		if lockedNow {
+			log.FromContext(ctx).Warn("locked account after failed sign ins", zap.String("user_id", u.ID))
+		}
+		return "", u, wrong
+	}
+
+	if locked {
+		return "", u, apperr.New(apperr.CodeRateLimited, "Too many failed attempts. Try again later or reset your password.")
+	}
+
+	if !u.Verified {
+		now := time.Now()
+		resend, err := s.store.RecordVerificationSent(ctx, u.ID, now.Add(-verifyResendInterval), now)
+		if err != nil {
+			return "", u, errors.Wrap(err, "recording verification email")
+		}
+		if !resend {
+			return "", u, apperr.New(apperr.CodePermissionDenied, "Verify your email before signing in. Use the link we emailed you.")
+		}
+		err = s.sendVerification(ctx, u)
+		if err != nil {
+			return "", u, err
+		}
+		return "", u, apperr.New(apperr.CodePermissionDenied, "Verify your email before signing in. We sent you a new link.")
+	}
+
+	if u.FailedLogins > 0 {
+		u.FailedLogins = 0
+		err = s.store.ResetFailedLogins(ctx, u.ID)
+		if err != nil {
+			return "", u, errors.Wrap(err, "resetting failed sign ins")
+		}
+	}
+
+	token, err = s.issueToken(ctx, u.ID, PurposeSession, s.config.SessionTTL)
+	return token, u, err
+}
+
+// ExternalLogin starts a session for a user who signed in with an identity provider, e.g. with
+// OpenID Connect. The user is created the first time and their name and roles are updated from
+// the provider every time. External users have no email or password so they can only sign in
+// through their provider.
+func (s *Service) ExternalLogin(ctx context.Context, p *auth.Principal) (token string, u User, err error) {
+	u, err = s.store.UserByID(ctx, p.ID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		u = User{
+			ID:        p.ID,
+			Name:      p.Name,
+			Roles:     p.Roles,
+			Verified:  true,
+			CreatedAt: time.Now(),
+		}
+		err = s.store.CreateUser(ctx, u)
+		if err != nil {
+			return "", u, errors.Wrap(err, "creating external user")
+		}
+		log.FromContext(ctx).Info("external user signed up", zap.String("user_id", u.ID), zap.String("auth_method", string(p.Method)))
+	case err != nil:
+		return "", u, errors.Wrap(err, "loading user")
+	default:
+		u.Name = p.Name
+		u.Roles = p.Roles
+		err = s.store.UpdateUser(ctx, u)
+		if err != nil {
+			return "", u, errors.Wrap(err, "updating external user")
+		}
+	}
+
+	token, err = s.issueToken(ctx, u.ID, PurposeSession, s.config.SessionTTL)
+	return token, u, err
+}
+
+// Logout ends the session
+func (s *Service) Logout(ctx context.Context, token string) error {
+	_, err := s.store.TakeToken(ctx, hashToken(token), PurposeSession)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return errors.Wrap(err, "deleting session")
+}
+
+// Authenticate returns the principal of the session. It is the lookup of auth.SessionCookie.
+func (s *Service) Authenticate(ctx context.Context, token string) (*auth.Principal, error) {
+	t, err := s.store.Token(ctx, hashToken(token))
+	if errors.Is(err, ErrNotFound) || (err == nil && (t.Purpose != PurposeSession || time.Now().After(t.Expires))) {
+		return nil, auth.ErrNoCredentials
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "loading session")
+	}
+
+	u, err := s.store.UserByID(ctx, t.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, auth.ErrNoCredentials
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "loading user")
+	}
+	return u.Principal(), nil
+}
+
+// ForgotPassword emails a password reset link if the email has an account. It succeeds either
+// way so it can't be used to find out who has an account.
+func (s *Service) ForgotPassword(ctx context.Context, email string) error {
+	email = strings.TrimSpace(email)
+	if msg := validateEmail(email); msg != "" {
+		return apperr.New(apperr.CodeInvalidArgument, "Check the highlighted fields").WithField("email", msg)
+	}
+
+	u, err := s.store.UserByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "loading user")
+	}
+
+	token, err := s.issueToken(ctx, u.ID, PurposeReset, resetTTL)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Reset your password with this link, it expires in an hour:\n\n%s/reset-password?token=%s\n\nIf you didn't ask for this you can ignore this email.",
+			s.config.BaseURL, token),
+	})
+}
+
+// CheckResetToken reports whether the reset token can still be used, so the reset page can say
+// the link expired before the user picks a new password
+func (s *Service) CheckResetToken(ctx context.Context, token string) error {
+	return s.checkToken(ctx, token, PurposeReset)
+}
+
+// ResetPassword sets a new password with the token from a reset email. It also verifies the
+// email (the user just proved they can read it), unlocks the account and ends every session.
+func (s *Service) ResetPassword(ctx context.Context, token, password string) error {
+	if msg := validatePassword(password); msg != "" {
+		return apperr.New(apperr.CodeInvalidArgument, "Check the highlighted fields").WithField("password", msg)
+	}
+
+	t, err := s.takeToken(ctx, token, PurposeReset)
+	if err != nil {
+		return err
+	}
+
+	u, err := s.store.UserByID(ctx, t.UserID)
+	if err != nil {
+		return errors.Wrap(err, "loading user")
+	}
+	u.PasswordHash, err = HashPassword(password, s.config.PasswordParams)
+	if err != nil {
+		return err
+	}
+	u.Verified = true
+	u.FailedLogins = 0
+	u.LockedUntil = time.Time{}
+	err = s.store.UpdateUser(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+
+	log.FromContext(ctx).Info("password reset", zap.String("user_id", u.ID))
+	return errors.Wrap(s.store.DeleteTokens(ctx, u.ID, PurposeSession), "ending sessions")
+}
+
+func (s *Service) sendVerification(ctx context.Context, u User) error {
+	token, err := s.issueToken(ctx, u.ID, PurposeVerify, verifyTTL)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, Message{
+		To:      u.Email,
+		Subject: "Verify your email",
+		Body:    fmt.Sprintf("Hi %s,\n\nVerify your email with this link:\n\n%s/verify?token=%s", u.Name, s.config.BaseURL, token),
+	})
+}
+
+// issueToken creates a random token for the user. Only its hash is stored.
+func (s *Service) issueToken(ctx context.Context, userID string, purpose Purpose, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "generating token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	err = s.store.SaveToken(ctx, Token{
+		Hash:    hashToken(token),
+		Purpose: purpose,
+		UserID:  userID,
+		Expires: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "saving token | purpose=[%s]", purpose)
+	}
+	return token, nil
+}
+
+// checkToken reports whether takeToken would succeed without taking the token
+func (s *Service) checkToken(ctx context.Context, token string, purpose Purpose) error {
+	t, err := s.store.Token(ctx, hashToken(token))
+	if errors.Is(err, ErrNotFound) || (err == nil && (t.Purpose != purpose || time.Now().After(t.Expires))) {
+		return invalidLink()
+	}
+	return errors.Wrap(err, "loading token")
+}
+
+// takeToken uses up the token. It is gone even if it turns out to be expired, but a token issued
+// for another purpose is left alone so e.g. a session can't be ended through the verify page.
+func (s *Service) takeToken(ctx context.Context, token string, purpose Purpose) (Token, error) {
+	t, err := s.store.TakeToken(ctx, hashToken(token), purpose)
+	if errors.Is(err, ErrNotFound) {
+		return t, invalidLink()
+	}
+	if err != nil {
+		return t, errors.Wrap(err, "loading token")
+	}
+	if time.Now().After(t.Expires) {
+		return t, invalidLink()
+	}
+	return t, nil
+}
+
+func invalidLink() error {
+	return apperr.New(apperr.CodeInvalidArgument, "This link is invalid or has expired")
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateEmail(email string) string {
+	if email == "" {
+		return "Enter your email"
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "Enter a valid email address"
+	}
+	return ""
+}
+
+func validatePassword(password string) string {
+	n := utf8.RuneCountInString(password)
+	switch {
+	case n < minPasswordLength:
+		return fmt.Sprintf("Use at least %d characters", minPasswordLength)
+	case n > maxPasswordLength:
+		return fmt.Sprintf("Use at most %d characters", maxPasswordLength)
+	}
+	return ""
+}
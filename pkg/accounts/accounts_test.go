@@ -0,0 +1,296 @@
+package accounts
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// testParams keep the tests fast, never use them for real passwords
+var testParams = PasswordParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+type mailbox struct {
+	messages []Message
+}
+
+func (m *mailbox) Send(ctx context.Context, msg Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+var tokenRE = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// token is the token in the link of the last email
+func (m *mailbox) token(t *testing.T) string {
+	require.NotEmpty(t, m.messages)
+	match := tokenRE.FindStringSubmatch(m.messages[len(m.messages)-1].Body)
+	require.Len(t, match, 2)
+	return match[1]
+}
+
+func newTestService(t *testing.T) (*Service, *mailbox) {
+	mail := &mailbox{}
+	s, err := NewService(NewMemoryStore(), mail, Config{
+		BaseURL:         "https://example.com",
+		SessionTTL:      time.Hour,
+		MaxFailedLogins: 3,
+		LockoutDuration: time.Minute,
+		PasswordParams:  testParams,
+	})
+	require.NoError(t, err)
+	return s, mail
+}
+
+func assertCode(t *testing.T, code apperr.Code, err error) *apperr.Error {
+	var ae *apperr.Error
+	require.True(t, errors.As(err, &ae), "expected an apperr, got %v", err)
+	assert.Equal(t, code, ae.Code)
+	return ae
+}
+
+func TestSignup(t *testing.T) {
+	type tc struct {
+		name         string
+		email        string
+		password     string
+		expectFields []string
+	}
+
+	tests := map[string]tc{
+		"valid": {
+			name:     "Alice",
+			email:    "alice@example.com",
+			password: "a long enough password",
+		},
+		"everything missing": {
+			expectFields: []string{"name", "email", "password"},
+		},
+		"invalid email and short password": {
+			name:         "Alice",
+			email:        "Alice <alice@example.com>",
+			password:     "short",
+			expectFields: []string{"email", "password"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, mail := newTestService(t)
+			err := s.Signup(context.Background(), tc.name, tc.email, tc.password)
+			if len(tc.expectFields) == 0 {
+				require.NoError(t, err)
+				require.Len(t, mail.messages, 1)
+				assert.Equal(t, tc.email, mail.messages[0].To)
+				assert.Contains(t, mail.messages[0].Body, "https://example.com/verify?token=")
+				return
+			}
+
+			ae := assertCode(t, apperr.CodeInvalidArgument, err)
+			var fields []string
+			for _, f := range ae.Fields {
+				fields = append(fields, f.Field)
+			}
+			assert.Equal(t, tc.expectFields, fields)
+			assert.Empty(t, mail.messages)
+		})
+	}
+}
+
+func TestAccountFlow(t *testing.T) {
+	ctx := context.Background()
+	s, mail := newTestService(t)
+
+	require.NoError(t, s.Signup(ctx, "Alice", "alice@example.com", "a long enough password"))
+	verifyToken := mail.token(t)
+
+	// signing up again doesn't reveal the account exists but lets the owner know
+	require.NoError(t, s.Signup(ctx, "Mallory", "ALICE@example.com", "another long password"))
+	require.Len(t, mail.messages, 2)
+	assert.Equal(t, "You already have an account", mail.messages[1].Subject)
+
+	// the email has to be verified first. The link was just sent so no new one is.
+	_, _, err := s.Login(ctx, "alice@example.com", "a long enough password")
+	assertCode(t, apperr.CodePermissionDenied, err)
+	require.Len(t, mail.messages, 2)
+
+	// a while later signing in sends a new link
+	u, err := s.store.UserByEmail(ctx, "alice@example.com")
+	require.NoError(t, err)
+	u.VerificationSentAt = u.VerificationSentAt.Add(-verifyResendInterval)
+	require.NoError(t, s.store.UpdateUser(ctx, u))
+	_, _, err = s.Login(ctx, "alice@example.com", "a long enough password")
+	assertCode(t, apperr.CodePermissionDenied, err)
+	require.Len(t, mail.messages, 3)
+
+	u, err = s.Verify(ctx, verifyToken)
+	require.NoError(t, err)
+	assert.True(t, u.Verified)
+
+	// links can only be used once
+	_, err = s.Verify(ctx, verifyToken)
+	assertCode(t, apperr.CodeInvalidArgument, err)
+
+	token, _, err := s.Login(ctx, "alice@example.com", "a long enough password")
+	require.NoError(t, err)
+	p, err := s.Authenticate(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, u.ID, p.ID)
+	assert.Equal(t, "Alice", p.Name)
+
+	// a session presented as a link isn't used up
+	_, err = s.Verify(ctx, token)
+	assertCode(t, apperr.CodeInvalidArgument, err)
+	_, err = s.Authenticate(ctx, token)
+	require.NoError(t, err)
+
+	// a verification token isn't a session
+	_, err = s.Authenticate(ctx, mail.token(t))
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+
+	require.NoError(t, s.ForgotPassword(ctx, "alice@example.com"))
+	resetToken := mail.token(t)
+	require.NoError(t, s.CheckResetToken(ctx, resetToken))
+
+	// signing out with a reset token doesn't use it up
+	require.NoError(t, s.Logout(ctx, resetToken))
+	require.NoError(t, s.CheckResetToken(ctx, resetToken))
+
+	// the new password is validated before the token is used up
+	err = s.ResetPassword(ctx, resetToken, "short")
+	assertCode(t, apperr.CodeInvalidArgument, err)
+	require.NoError(t, s.ResetPassword(ctx, resetToken, "a brand new password"))
+	assertCode(t, apperr.CodeInvalidArgument, s.CheckResetToken(ctx, resetToken))
+
+	// resetting the password ends every session
+	_, err = s.Authenticate(ctx, token)
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+
+	_, _, err = s.Login(ctx, "alice@example.com", "a long enough password")
+	assertCode(t, apperr.CodeUnauthenticated, err)
+	token, _, err = s.Login(ctx, "alice@example.com", "a brand new password")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Logout(ctx, token))
+	_, err = s.Authenticate(ctx, token)
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+
+	// unknown emails look the same as known ones
+	sent := len(mail.messages)
+	require.NoError(t, s.ForgotPassword(ctx, "bob@example.com"))
+	assert.Len(t, mail.messages, sent)
+	_, _, err = s.Login(ctx, "bob@example.com", "a brand new password")
+	assertCode(t, apperr.CodeUnauthenticated, err)
+}
+
+func TestLockout(t *testing.T) {
+	ctx := context.Background()
+	s, mail := newTestService(t)
+
+	require.NoError(t, s.Signup(ctx, "Alice", "alice@example.com", "a long enough password"))
+	_, err := s.Verify(ctx, mail.token(t))
+	require.NoError(t, err)
+
+	// concurrent guesses are all counted
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, errs[i] = s.Login(ctx, "alice@example.com", "wrong password")
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assertCode(t, apperr.CodeUnauthenticated, err)
+	}
+
+	// a wrong password doesn't reveal the lock
+	_, _, err = s.Login(ctx, "alice@example.com", "wrong password")
+	assertCode(t, apperr.CodeUnauthenticated, err)
+
+	// even the right password is rejected while the account is locked
+	_, _, err = s.Login(ctx, "alice@example.com", "a long enough password")
+	assertCode(t, apperr.CodeRateLimited, err)
+
+	// resetting the password unlocks it
+	require.NoError(t, s.ForgotPassword(ctx, "alice@example.com"))
+	require.NoError(t, s.ResetPassword(ctx, mail.token(t), "a brand new password"))
+	_, _, err = s.Login(ctx, "alice@example.com", "a brand new password")
+	require.NoError(t, err)
+}
+
+func TestExternalLogin(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t)
+
+	token, u, err := s.ExternalLogin(ctx, &auth.Principal{ID: "corp:123", Name: "Alice", Roles: []string{auth.RoleAdmin}, Method: auth.MethodOIDC})
+	require.NoError(t, err)
+	assert.Equal(t, "corp:123", u.ID)
+	p, err := s.Authenticate(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{auth.RoleAdmin}, p.Roles)
+
+	// the provider is the source of truth for the name and roles
+	token, _, err = s.ExternalLogin(ctx, &auth.Principal{ID: "corp:123", Name: "Alice Smith", Method: auth.MethodOIDC})
+	require.NoError(t, err)
+	p, err = s.Authenticate(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, "Alice Smith", p.Name)
+	assert.Empty(t, p.Roles)
+}
+
+func TestLogMailer(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	ctx := log.NewContext(context.Background(), zap.New(core))
+	m := Message{To: "a@example.com", Subject: "Verify your email", Body: "https://example.com/verify?token=abc123&next=/"}
+
+	require.NoError(t, LogMailer{}.Send(ctx, m))
+	require.Equal(t, 1, logs.Len())
+	entry := logs.All()[0]
+	assert.Equal(t, zap.WarnLevel, entry.Level)
+	assert.Equal(t, "https://example.com/verify?token=[REDACTED]&next=/", entry.ContextMap()["body"])
+
+	// developers get the whole email to follow the link
+	var out strings.Builder
+	require.NoError(t, LogMailer{Dev: &out}.Send(ctx, m))
+	assert.Contains(t, out.String(), "token=abc123")
+	assert.Equal(t, 1, logs.Len())
+}
+
+func TestSMTPMailerContext(t *testing.T) {
+	// a server that accepts connections but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = SMTPMailer{Addr: l.Addr().String(), From: "no-reply@example.com"}.Send(ctx, Message{To: "a@example.com", Subject: "Hi", Body: "Hi"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,144 @@
+package accounts
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the verification and password reset emails
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// linkToken matches the tokens of the verification and reset links
+var linkToken = regexp.MustCompile(`([?&]token=)[^&\s]+`)
+
+// LogMailer writes emails to the log instead of sending them. Logs are read by more people than
+// the recipient, so the tokens of links are redacted, set Dev to follow the links while developing.
+type LogMailer struct {
+	// Dev prints whole emails, links included, to the writer instead, e.g. os.Stderr
+	Dev io.Writer
+}
+
+func (l LogMailer) Send(ctx context.Context, m Message) error {
+	if l.Dev != nil {
+		_, err := fmt.Fprintf(l.Dev, "To: %s\nSubject: %s\n\n%s\n\n", m.To, m.Subject, m.Body)
+		return errors.Wrap(err, "printing email")
+	}
+	log.FromContext(ctx).Warn("email not sent, no mail server is configured",
+		zap.String("to", m.To),
+		zap.String("subject", m.Subject),
+		zap.String("body", linkToken.ReplaceAllString(m.Body, "${1}"+log.Redacted)),
+	)
+	return nil
+}
+
+// smtpTimeout bounds sending an email when the context has no earlier deadline
+const smtpTimeout = 30 * time.Second
+
+// SMTPMailer sends emails through an SMTP server with PLAIN auth if a username is set. STARTTLS
+// is used when the server offers it.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPMailer) Send(ctx context.Context, m Message) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "parsing smtp address | addr=[%s]", s.Addr)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "connecting to smtp server | addr=[%s]", s.Addr)
+	}
+	defer conn.Close()
+	// the smtp client has no context support, so end the conversation when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return errors.Wrapf(err, "greeting smtp server | addr=[%s]", s.Addr)
+	}
+	defer c.Close()
+
+	err = s.send(c, host, m.To, b.String())
+	return errors.Wrapf(err, "sending email | subject=[%s]", m.Subject)
+}
+
+// send goes through the same steps as smtp.SendMail on an open connection
+func (s SMTPMailer) send(c *smtp.Client, host, to, msg string) error {
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err := c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return errors.Wrap(err, "starting tls")
+		}
+	}
+	if s.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp server doesn't support auth")
+		}
+		err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host))
+		if err != nil {
+			return errors.Wrap(err, "authenticating")
+		}
+	}
+
+	err := c.Mail(s.From)
+	if err != nil {
+		return errors.Wrap(err, "setting sender")
+	}
+	err = c.Rcpt(to)
+	if err != nil {
+		return errors.Wrap(err, "setting recipient")
+	}
+	w, err := c.Data()
+	if err != nil {
+		return errors.Wrap(err, "starting data")
+	}
+	_, err = io.WriteString(w, msg)
+	if err != nil {
+		return errors.Wrap(err, "writing message")
+	}
+	err = w.Close()
+	if err != nil {
+		return errors.Wrap(err, "ending data")
+	}
+	return errors.Wrap(c.Quit(), "quitting")
+}
@@ -0,0 +1,61 @@
+package accounts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassword(t *testing.T) {
+	type tc struct {
+		hash        func(t *testing.T) string
+		password    string
+		expectMatch bool
+		expectErr   bool
+	}
+
+	hash := func(password string) func(t *testing.T) string {
+		return func(t *testing.T) string {
+			h, err := HashPassword(password, DefaultPasswordParams)
+			require.NoError(t, err)
+			return h
+		}
+	}
+
+	tests := map[string]tc{
+		"matches": {
+			hash:        hash("correct horse battery staple"),
+			password:    "correct horse battery staple",
+			expectMatch: true,
+		},
+		"doesn't match": {
+			hash:     hash("correct horse battery staple"),
+			password: "correct horse battery stapler",
+		},
+		"hashes with other parameters still verify": {
+			hash: func(t *testing.T) string {
+				return "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$cpx6VEQbwTVZvcpxNIxOVUWZ5xnAipUmAe1cg2GMG70"
+			},
+			password:    "password",
+			expectMatch: true,
+		},
+		"not argon2id": {
+			hash:      func(t *testing.T) string { return "$2a$10$N9qo8uLOickgx2ZMRZoMye" },
+			password:  "password",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			match, err := VerifyPassword(tc.hash(t), tc.password)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectMatch, match)
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package accounts
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned by stores for users and tokens that don't exist
+	ErrNotFound = errors.New("not found")
+	// ErrEmailTaken is returned by stores when creating a user with an email that is already used
+	ErrEmailTaken = errors.New("email taken")
+)
+
+// Purpose is what a token was issued for. A token is only accepted for its own purpose.
+type Purpose string
+
+const (
+	PurposeSession Purpose = "session"
+	PurposeVerify  Purpose = "verify"
+	PurposeReset   Purpose = "reset"
+)
+
+// Token is an issued session, verification or reset token. Only the hash of the token is stored
+// so a leaked store can't be used to sign in.
+type Token struct {
+	Hash    string
+	Purpose Purpose
+	UserID  string
+	Expires time.Time
+}
+
+// Store persists users and tokens. Implement it on top of your database, NewMemoryStore is only
+// suitable for development and single instance deployments.
+type Store interface {
+	// CreateUser returns ErrEmailTaken if another user has the email
+	CreateUser(ctx context.Context, u User) error
+	UpdateUser(ctx context.Context, u User) error
+	// UserByID and UserByEmail return ErrNotFound if there is no such user. Emails are
+	// compared case insensitively.
+	UserByID(ctx context.Context, id string) (User, error)
+	UserByEmail(ctx context.Context, email string) (User, error)
+	// IncrementFailedLogins counts a failed sign in of the user in one step, so concurrent
+	// guesses are all counted. The max-th failure in a row locks the user until lockUntil and
+	// starts the count over.
+	IncrementFailedLogins(ctx context.Context, id string, max int, lockUntil time.Time) (locked bool, err error)
+	// ResetFailedLogins starts the count of failed sign ins over without touching the lock
+	ResetFailedLogins(ctx context.Context, id string) error
+	// RecordVerificationSent sets the VerificationSentAt of the user to now unless the last
+	// verification email was sent after since. It reports whether it did, in one step so
+	// concurrent sign ins send at most one email.
+	RecordVerificationSent(ctx context.Context, id string, since, now time.Time) (bool, error)
+
+	SaveToken(ctx context.Context, t Token) error
+	// Token returns ErrNotFound if there is no token with the hash
+	Token(ctx context.Context, hash string) (Token, error)
+	// TakeToken returns and deletes the token in one step so it can only be used once. It returns
+	// ErrNotFound and keeps the token if it was issued for another purpose.
+	TakeToken(ctx context.Context, hash string, purpose Purpose) (Token, error)
+	// DeleteTokens deletes every token of the user for the purpose, e.g. all of their sessions
+	DeleteTokens(ctx context.Context, userID string, purpose Purpose) error
+}
+
+// MemoryStore keeps users and tokens in memory
+type MemoryStore struct {
+	mu     sync.Mutex
+	users  map[string]User
+	emails map[string]string
+	tokens map[string]Token
+}
+
+// NewMemoryStore creates an empty in memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:  map[string]User{},
+		emails: map[string]string{},
+		tokens: map[string]Token{},
+	}
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[u.ID]; ok {
+		return errors.Errorf("user exists | id=[%s]", u.ID)
+	}
+	email := strings.ToLower(u.Email)
+	if _, ok := s.emails[email]; ok && email != "" {
+		return ErrEmailTaken
+	}
+	s.users[u.ID] = u.copy()
+	// external users have no email
+	if email != "" {
+		s.emails[email] = u.ID
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateUser(ctx context.Context, u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.users[u.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	email := strings.ToLower(u.Email)
+	if id, ok := s.emails[email]; ok && id != u.ID {
+		return ErrEmailTaken
+	}
+	delete(s.emails, strings.ToLower(old.Email))
+	s.users[u.ID] = u.copy()
+	if email != "" {
+		s.emails[email] = u.ID
+	}
+	return nil
+}
+
+func (s *MemoryStore) UserByID(ctx context.Context, id string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u.copy(), nil
+}
+
+func (s *MemoryStore) UserByEmail(ctx context.Context, email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.emails[strings.ToLower(email)]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return s.users[id].copy(), nil
+}
+
+func (s *MemoryStore) IncrementFailedLogins(ctx context.Context, id string, max int, lockUntil time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return false, ErrNotFound
+	}
+	u.FailedLogins++
+	locked := u.FailedLogins >= max
+	if locked {
+		u.FailedLogins = 0
+		u.LockedUntil = lockUntil
+	}
+	s.users[id] = u
+	return locked, nil
+}
+
+func (s *MemoryStore) ResetFailedLogins(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.FailedLogins = 0
+	s.users[id] = u
+	return nil
+}
+
+func (s *MemoryStore) RecordVerificationSent(ctx context.Context, id string, since, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if u.VerificationSentAt.After(since) {
+		return false, nil
+	}
+	u.VerificationSentAt = now
+	s.users[id] = u
+	return true, nil
+}
+
+func (s *MemoryStore) SaveToken(ctx context.Context, t Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// there is no background job to expire tokens, so sweep them whenever a new one is issued
+	now := time.Now()
+	for hash, t := range s.tokens {
+		if now.After(t.Expires) {
+			delete(s.tokens, hash)
+		}
+	}
+	s.tokens[t.Hash] = t
+	return nil
+}
+
+func (s *MemoryStore) Token(ctx context.Context, hash string) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[hash]
+	if !ok {
+		return Token{}, ErrNotFound
+	}
+	return t, nil
+}
+
+func (s *MemoryStore) TakeToken(ctx context.Context, hash string, purpose Purpose) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[hash]
+	if !ok || t.Purpose != purpose {
+		return Token{}, ErrNotFound
+	}
+	delete(s.tokens, hash)
+	return t, nil
+}
+
+func (s *MemoryStore) DeleteTokens(ctx context.Context, userID string, purpose Purpose) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, t := range s.tokens {
+		if t.UserID == userID && t.Purpose == purpose {
+			delete(s.tokens, hash)
+		}
+	}
+	return nil
+}
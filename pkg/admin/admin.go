@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/grindlemire/gothem-stack/pkg/log"
+	"github.com/grindlemire/gothem-stack/pkg/metrics"
+
+	"go.uber.org/zap"
+)
+
+// NewHandler builds the handler for the admin/ops listener. It exposes:
+//
+//	/debug/pprof/  - net/http/pprof profiles
+//	/debug/vars    - expvar
+//	/buildinfo     - the go build info of the binary
+//	/metrics       - prometheus metrics
+//	/loglevel      - GET the zap level or PUT level=debug (or json {"level": "debug"}) to change it at runtime
+//
+// These are sensitive so the listener should never be exposed publicly.
+func NewHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// register pprof explicitly rather than importing it for side effects so nothing leaks
+	// onto http.DefaultServeMux
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/buildinfo", buildInfo)
+	mux.Handle("/metrics", metrics.Handler())
+
+	level := log.Level()
+	mux.Handle("/loglevel", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			before := level.Level()
+			defer func() {
+				if after := level.Level(); after != before {
+					zap.S().Infof("log level changed from %s to %s", before, after)
+				}
+			}()
+		}
+		level.ServeHTTP(w, r)
+	}))
+
+	return mux
+}
+
+// BuildInfo is the build information embedded in the binary by the go toolchain
+type BuildInfo struct {
+	GoVersion string            `json:"go_version"`
+	Path      string            `json:"path"`
+	Version   string            `json:"version"`
+	Settings  map[string]string `json:"settings"`
+}
+
+func buildInfo(w http.ResponseWriter, r *http.Request) {
+	info := BuildInfo{GoVersion: runtime.Version(), Settings: map[string]string{}}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Path = bi.Path
+		info.Version = bi.Main.Version
+		// settings include the vcs revision, commit time and whether the tree was modified
+		for _, s := range bi.Settings {
+			info.Settings[s.Key] = s.Value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(info)
+	if err != nil {
+		zap.S().Errorf("encoding build info: %v", err)
+	}
+}
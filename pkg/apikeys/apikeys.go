@@ -0,0 +1,260 @@
+// Package apikeys issues long lived API keys to machine clients like partner integrations. Keys
+// carry scopes that limit what they can do, can expire and can be revoked. Only hashes of keys are
+// stored, the key itself is shown once when it is created.
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// Prefix starts every key so keys can be told apart from other bearer tokens and leaked keys
+	// are easy to spot, e.g. by secret scanners
+	Prefix = "gsk_"
+	// Header is the header keys can be sent in instead of Authorization
+	Header = "X-API-Key"
+
+	// hintLength is how much of a key is kept to tell keys apart
+	hintLength = len(Prefix) + 6
+	// lastUsedResolution is how often using a key is recorded, so not every request writes
+	lastUsedResolution = time.Minute
+	maxNameLength      = 100
+)
+
+// Scope is something keys can be allowed to do. Route groups require a scope with
+// auth.RequireScope.
+type Scope struct {
+	Name        string
+	Description string
+}
+
+// Key is an issued API key
+type Key struct {
+	ID   string
+	Name string
+	// Hint is the start of the key so owners can tell their keys apart
+	Hint    string
+	Hash    string
+	OwnerID string
+	Scopes  []string
+
+	CreatedAt time.Time
+	// ExpiresAt is zero for keys that don't expire
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+// Expired reports whether the key expired at the time
+func (k Key) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// Revoked reports whether the key was revoked
+func (k Key) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// Principal is the key as the principal of a request. It has the scopes of the key and no roles.
+func (k Key) Principal() *auth.Principal {
+	return &auth.Principal{ID: "apikey:" + k.ID, Name: k.Name, Scopes: k.Scopes, Method: auth.MethodAPIKey}
+}
+
+func (k Key) copy() Key {
+	k.Scopes = slices.Clone(k.Scopes)
+	return k
+}
+
+// Service issues, lists, revokes and authenticates keys
+type Service struct {
+	store  Store
+	scopes []Scope
+}
+
+// NewService creates the API key service. Keys can only be issued with the scopes.
+func NewService(store Store, scopes []Scope) (s *Service, err error) {
+	for i, scope := range scopes {
+		if scope.Name == "" {
+			return s, errors.New("scope has no name")
+		}
+		if slices.ContainsFunc(scopes[:i], func(other Scope) bool { return other.Name == scope.Name }) {
+			return s, errors.Errorf("duplicate scope | scope=[%s]", scope.Name)
+		}
+	}
+	return &Service{store: store, scopes: scopes}, nil
+}
+
+// Scopes are the scopes keys can be issued with
+func (s *Service) Scopes() []Scope {
+	return s.scopes
+}
+
+// Create issues a key for the owner. A ttl of 0 creates a key that doesn't expire. The returned
+// key can't be recovered later, show it to the owner once.
+func (s *Service) Create(ctx context.Context, owner *auth.Principal, name string, scopes []string, ttl time.Duration) (key string, k Key, err error) {
+	name = strings.TrimSpace(name)
+
+	ae := apperr.New(apperr.CodeInvalidArgument, "Check the highlighted fields")
+	switch {
+	case name == "":
+		ae.WithField("name", "Name the key, e.g. after the integration using it")
+	case utf8.RuneCountInString(name) > maxNameLength:
+		ae.WithField("name", "Use a shorter name")
+	}
+	switch {
+	case len(scopes) == 0:
+		ae.WithField("scopes", "Pick at least one scope")
+	case slices.ContainsFunc(scopes, func(scope string) bool { return !s.known(scope) }):
+		ae.WithField("scopes", "Pick from the listed scopes")
+	case slices.ContainsFunc(scopes, func(scope string) bool { return !owner.HasScope(scope) }):
+		// a key can't do more than its owner
+		ae.WithField("scopes", "Pick only scopes you have")
+	}
+	if ttl < 0 {
+		ae.WithField("expires", "Pick when the key expires")
+	}
+	if len(ae.Fields) > 0 {
+		return "", k, ae
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", k, errors.Wrap(err, "generating key")
+	}
+	key = Prefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	k = Key{
+		ID:        uuid.NewString(),
+		Name:      name,
+		Hint:      key[:hintLength],
+		Hash:      hashKey(key),
+		OwnerID:   owner.ID,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(scopes))),
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		k.ExpiresAt = now.Add(ttl)
+	}
+	err = s.store.CreateKey(ctx, k)
+	if err != nil {
+		return "", k, errors.Wrap(err, "creating key")
+	}
+
+	log.FromContext(ctx).Info("api key created", zap.String("key_id", k.ID), zap.Strings("scopes", k.Scopes))
+	return key, k, nil
+}
+
+// Keys returns the keys of the owner, newest first
+func (s *Service) Keys(ctx context.Context, owner *auth.Principal) ([]Key, error) {
+	keys, err := s.store.KeysByOwner(ctx, owner.ID)
+	return keys, errors.Wrap(err, "loading keys")
+}
+
+// Revoke revokes the key of the owner. Revoking a key twice is fine.
+func (s *Service) Revoke(ctx context.Context, owner *auth.Principal, id string) (Key, error) {
+	k, err := s.store.KeyByID(ctx, id)
+	// other people's keys don't exist as far as the owner is concerned
+	if errors.Is(err, ErrNotFound) || (err == nil && k.OwnerID != owner.ID) {
+		return Key{}, apperr.New(apperr.CodeNotFound, "There is no such key")
+	}
+	if err != nil {
+		return Key{}, errors.Wrap(err, "loading key")
+	}
+	if k.Revoked() {
+		return k, nil
+	}
+
+	k.RevokedAt = time.Now()
+	err = s.store.UpdateKey(ctx, k)
+	if err != nil {
+		return k, errors.Wrap(err, "revoking key")
+	}
+	log.FromContext(ctx).Info("api key revoked", zap.String("key_id", k.ID))
+	return k, nil
+}
+
+// Authenticate returns the principal of the key and records that it was used
+func (s *Service) Authenticate(ctx context.Context, key string) (*auth.Principal, error) {
+	k, err := s.store.KeyByHash(ctx, hashKey(key))
+	if errors.Is(err, ErrNotFound) {
+		return nil, errors.New("unknown api key")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "loading key")
+	}
+
+	now := time.Now()
+	switch {
+	case k.Revoked():
+		return nil, apperr.New(apperr.CodeUnauthenticated, "The API key was revoked")
+	case k.Expired(now):
+		return nil, apperr.New(apperr.CodeUnauthenticated, "The API key expired")
+	}
+
+	if now.Sub(k.LastUsedAt) >= lastUsedResolution {
+		err = s.store.TouchKey(ctx, k.ID, now)
+		if err != nil {
+			// not worth failing the request over
+			log.FromContext(ctx).Warn("recording api key use", zap.String("key_id", k.ID), zap.Error(err))
+		}
+	}
+	return k.Principal(), nil
+}
+
+// Authenticator accepts keys in the X-API-Key header or as bearer tokens. Bearer tokens without
+// the Prefix are left to the other authenticators of the chain, e.g. auth.JWT.
+func (s *Service) Authenticator() auth.Authenticator {
+	return &authenticator{service: s}
+}
+
+func (s *Service) known(scope string) bool {
+	return slices.ContainsFunc(s.scopes, func(known Scope) bool { return known.Name == scope })
+}
+
+type authenticator struct {
+	service *Service
+}
+
+func (a *authenticator) Authenticate(c echo.Context) (*auth.Principal, error) {
+	key := c.Request().Header.Get(Header)
+	if key == "" {
+		scheme, token, ok := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+		if !ok || !strings.EqualFold(scheme, "bearer") || !strings.HasPrefix(token, Prefix) {
+			return nil, auth.ErrNoCredentials
+		}
+		key = token
+	}
+	return a.service.Authenticate(c.Request().Context(), key)
+}
+
+func (a *authenticator) Challenge() string {
+	return "Bearer"
+}
+
+func (a *authenticator) ChallengeError(err error) string {
+	return `Bearer error="invalid_token"`
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
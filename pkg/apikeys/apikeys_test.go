@@ -0,0 +1,247 @@
+package apikeys
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	alice = &auth.Principal{ID: "alice", AllScopes: true, Method: auth.MethodSession}
+	bob   = &auth.Principal{ID: "bob", AllScopes: true, Method: auth.MethodSession}
+)
+
+func newTestService(t *testing.T) (*Service, *MemoryStore) {
+	store := NewMemoryStore()
+	s, err := NewService(store, []Scope{{Name: "orders:read"}, {Name: "orders:write"}})
+	require.NoError(t, err)
+	return s, store
+}
+
+func assertCode(t *testing.T, code apperr.Code, err error) *apperr.Error {
+	var ae *apperr.Error
+	require.True(t, errors.As(err, &ae), "expected an apperr, got %v", err)
+	assert.Equal(t, code, ae.Code)
+	return ae
+}
+
+func TestCreate(t *testing.T) {
+	type tc struct {
+		owner        *auth.Principal
+		name         string
+		scopes       []string
+		ttl          time.Duration
+		expectScopes []string
+		expectFields []string
+	}
+
+	tests := map[string]tc{
+		"valid": {
+			name:         "Acme integration",
+			scopes:       []string{"orders:write", "orders:read", "orders:read"},
+			ttl:          24 * time.Hour,
+			expectScopes: []string{"orders:read", "orders:write"},
+		},
+		"doesn't expire": {
+			name:         "Acme integration",
+			scopes:       []string{"orders:read"},
+			expectScopes: []string{"orders:read"},
+		},
+		"missing everything": {
+			ttl:          -time.Hour,
+			expectFields: []string{"name", "scopes", "expires"},
+		},
+		"unknown scope": {
+			name:         "Acme integration",
+			scopes:       []string{"orders:read", "admin"},
+			expectFields: []string{"scopes"},
+		},
+		"scope the owner doesn't have": {
+			owner:        &auth.Principal{ID: "cert:billing", Scopes: []string{"orders:read"}, Method: auth.MethodClientCert},
+			name:         "Acme integration",
+			scopes:       []string{"orders:read", "orders:write"},
+			expectFields: []string{"scopes"},
+		},
+		"long name": {
+			name:         strings.Repeat("a", maxNameLength+1),
+			scopes:       []string{"orders:read"},
+			expectFields: []string{"name"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, store := newTestService(t)
+			owner := alice
+			if tc.owner != nil {
+				owner = tc.owner
+			}
+			key, k, err := s.Create(context.Background(), owner, tc.name, tc.scopes, tc.ttl)
+
+			if len(tc.expectFields) > 0 {
+				ae := assertCode(t, apperr.CodeInvalidArgument, err)
+				var fields []string
+				for _, f := range ae.Fields {
+					fields = append(fields, f.Field)
+				}
+				assert.ElementsMatch(t, tc.expectFields, fields)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(key, Prefix))
+			assert.True(t, strings.HasPrefix(key, k.Hint))
+			assert.Equal(t, tc.expectScopes, k.Scopes)
+			assert.Equal(t, tc.ttl == 0, k.ExpiresAt.IsZero())
+
+			// only the hash is stored
+			stored, err := store.KeyByID(context.Background(), k.ID)
+			require.NoError(t, err)
+			assert.Equal(t, hashKey(key), stored.Hash)
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	s, store := newTestService(t)
+
+	key, k, err := s.Create(ctx, alice, "Acme integration", []string{"orders:read"}, time.Hour)
+	require.NoError(t, err)
+
+	p, err := s.Authenticate(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, "apikey:"+k.ID, p.ID)
+	assert.Equal(t, auth.MethodAPIKey, p.Method)
+	assert.True(t, p.HasScope("orders:read"))
+	assert.False(t, p.HasScope("orders:write"))
+	assert.False(t, p.HasRole(auth.RoleAdmin))
+
+	// the use is recorded, but not on every request
+	stored, err := store.KeyByID(ctx, k.ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), stored.LastUsedAt, time.Second)
+	lastUsed := stored.LastUsedAt
+	_, err = s.Authenticate(ctx, key)
+	require.NoError(t, err)
+	stored, err = store.KeyByID(ctx, k.ID)
+	require.NoError(t, err)
+	assert.Equal(t, lastUsed, stored.LastUsedAt)
+
+	_, err = s.Authenticate(ctx, key+"x")
+	assert.Error(t, err)
+
+	// other people can't revoke the key
+	_, err = s.Revoke(ctx, bob, k.ID)
+	assertCode(t, apperr.CodeNotFound, err)
+	_, err = s.Revoke(ctx, alice, k.ID)
+	require.NoError(t, err)
+	_, err = s.Authenticate(ctx, key)
+	assertCode(t, apperr.CodeUnauthenticated, err)
+
+	// expired keys are rejected
+	key, k, err = s.Create(ctx, alice, "Old integration", []string{"orders:read"}, time.Hour)
+	require.NoError(t, err)
+	k.ExpiresAt = time.Now().Add(-time.Minute)
+	require.NoError(t, store.UpdateKey(ctx, k))
+	_, err = s.Authenticate(ctx, key)
+	assertCode(t, apperr.CodeUnauthenticated, err)
+
+	keys, err := s.Keys(ctx, alice)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "Old integration", keys[0].Name)
+	keys, err = s.Keys(ctx, bob)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestService(t)
+	key, _, err := s.Create(ctx, alice, "Acme integration", []string{"orders:read"}, 0)
+	require.NoError(t, err)
+
+	chain := auth.NewChain(
+		s.Authenticator(),
+		auth.Bearer(func(ctx context.Context, token string) (*auth.Principal, error) {
+			return &auth.Principal{ID: "jwt", AllScopes: true, Method: auth.MethodBearer}, nil
+		}),
+	)
+
+	type tc struct {
+		headers         map[string]string
+		scope           string
+		expectPrincipal string
+		expectCode      apperr.Code
+	}
+
+	tests := map[string]tc{
+		"api key header": {
+			headers:         map[string]string{Header: key},
+			scope:           "orders:read",
+			expectPrincipal: "apikey:",
+		},
+		"bearer": {
+			headers:         map[string]string{echo.HeaderAuthorization: "Bearer " + key},
+			scope:           "orders:read",
+			expectPrincipal: "apikey:",
+		},
+		"other bearer tokens are left to the chain": {
+			headers:         map[string]string{echo.HeaderAuthorization: "Bearer eyJhbGciOi"},
+			scope:           "orders:read",
+			expectPrincipal: "jwt",
+		},
+		"wrong key": {
+			headers:    map[string]string{Header: Prefix + "guess"},
+			expectCode: apperr.CodeUnauthenticated,
+		},
+		"missing scope": {
+			headers:    map[string]string{Header: key},
+			scope:      "orders:write",
+			expectCode: apperr.CodePermissionDenied,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+
+			var got *auth.Principal
+			h := func(c echo.Context) error {
+				got, _ = auth.PrincipalFromContext(c.Request().Context())
+				return nil
+			}
+			if tc.scope != "" {
+				h = auth.RequireScope(tc.scope)(h)
+			}
+			err := chain.Middleware(auth.Required)(h)(echo.New().NewContext(req, rec))
+
+			if tc.expectCode != "" {
+				assertCode(t, tc.expectCode, err)
+				assert.Nil(t, got)
+				if tc.expectCode == apperr.CodeUnauthenticated {
+					assert.Equal(t, []string{`Bearer error="invalid_token"`, "Bearer"}, rec.Header().Values(echo.HeaderWWWAuthenticate))
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, got)
+			assert.True(t, strings.HasPrefix(got.ID, tc.expectPrincipal))
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package apikeys
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by stores for keys that don't exist
+var ErrNotFound = errors.New("not found")
+
+// Store persists API keys. Implement it on top of your database, NewMemoryStore is only suitable
+// for development and single instance deployments.
+type Store interface {
+	CreateKey(ctx context.Context, k Key) error
+	UpdateKey(ctx context.Context, k Key) error
+	// TouchKey only sets when the key was last used, so it can't undo a concurrent revocation
+	TouchKey(ctx context.Context, id string, lastUsed time.Time) error
+	// KeyByID and KeyByHash return ErrNotFound if there is no such key
+	KeyByID(ctx context.Context, id string) (Key, error)
+	KeyByHash(ctx context.Context, hash string) (Key, error)
+	// KeysByOwner returns the keys the owner created, newest first
+	KeysByOwner(ctx context.Context, ownerID string) ([]Key, error)
+}
+
+// MemoryStore keeps keys in memory
+type MemoryStore struct {
+	mu     sync.Mutex
+	keys   map[string]Key
+	hashes map[string]string
+}
+
+// NewMemoryStore creates an empty in memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		keys:   map[string]Key{},
+		hashes: map[string]string{},
+	}
+}
+
+func (s *MemoryStore) CreateKey(ctx context.Context, k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[k.ID]; ok {
+		return errors.Errorf("key exists | id=[%s]", k.ID)
+	}
+	s.keys[k.ID] = k.copy()
+	s.hashes[k.Hash] = k.ID
+	return nil
+}
+
+func (s *MemoryStore) UpdateKey(ctx context.Context, k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[k.ID]; !ok {
+		return ErrNotFound
+	}
+	s.keys[k.ID] = k.copy()
+	return nil
+}
+
+func (s *MemoryStore) TouchKey(ctx context.Context, id string, lastUsed time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	k.LastUsedAt = lastUsed
+	s.keys[id] = k
+	return nil
+}
+
+func (s *MemoryStore) KeyByID(ctx context.Context, id string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	return k.copy(), nil
+}
+
+func (s *MemoryStore) KeyByHash(ctx context.Context, hash string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.hashes[hash]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	return s.keys[id].copy(), nil
+}
+
+func (s *MemoryStore) KeysByOwner(ctx context.Context, ownerID string) ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []Key
+	for _, k := range s.keys {
+		if k.OwnerID == ownerID {
+			keys = append(keys, k.copy())
+		}
+	}
+	slices.SortFunc(keys, func(a, b Key) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return keys, nil
+}
@@ -0,0 +1,180 @@
+// Package apperr is the error type handlers return when they know what went wrong. It carries
+// everything handler.Error needs to log and render the failure consistently for browsers, htmx
+// and json clients.
+package apperr
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+)
+
+// Code is a stable machine readable error code clients can switch on
+type Code string
+
+const (
+	CodeInvalidArgument  Code = "invalid_argument"
+	CodeUnauthenticated  Code = "unauthenticated"
+	CodePermissionDenied Code = "permission_denied"
+	CodeNotFound         Code = "not_found"
+	CodeConflict         Code = "conflict"
+	CodeRateLimited      Code = "rate_limited"
+	CodeInternal         Code = "internal"
+	CodeUnavailable      Code = "unavailable"
+)
+
+// statuses are the default http statuses of the codes
+var statuses = map[Code]int{
+	CodeInvalidArgument:  http.StatusBadRequest,
+	CodeUnauthenticated:  http.StatusUnauthorized,
+	CodePermissionDenied: http.StatusForbidden,
+	CodeNotFound:         http.StatusNotFound,
+	CodeConflict:         http.StatusConflict,
+	CodeRateLimited:      http.StatusTooManyRequests,
+	CodeInternal:         http.StatusInternalServerError,
+	CodeUnavailable:      http.StatusServiceUnavailable,
+}
+
+// FieldError is a problem with a single input, e.g. a form field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is an application error. Message is shown to users, the cause never is.
+type Error struct {
+	Code    Code
+	Status  int
+	Message string
+	Fields  []FieldError
+	// Level is the level the error is logged at
+	Level zapcore.Level
+
+	cause error
+	stack []uintptr
+}
+
+// New creates an error with the default status and log level of the code
+func New(code Code, message string) *Error {
+	return newError(code, message, nil)
+}
+
+// Wrap creates an error for the internal cause err. The cause is logged but not shown to users.
+func Wrap(err error, code Code, message string) *Error {
+	return newError(code, message, err)
+}
+
+func newError(code Code, message string, cause error) *Error {
+	status, ok := statuses[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+
+	return &Error{
+		Code:    code,
+		Status:  status,
+		Message: message,
+		Level:   defaultLevel(status),
+		cause:   cause,
+		stack:   pcs[:n],
+	}
+}
+
+// FromStatus creates an error for an http status, e.g. from an *echo.HTTPError. It doesn't record
+// a stack because it is created where the error is handled rather than where it happened.
+func FromStatus(status int, message string, cause error) *Error {
+	return &Error{
+		Code:    codeForStatus(status),
+		Status:  status,
+		Message: message,
+		Level:   defaultLevel(status),
+		cause:   cause,
+	}
+}
+
+// HTTPStatus is the status err is answered with: the status of an *Error or *echo.HTTPError in its
+// chain, or 500 for anything else. Middleware uses it to record the status of errors that haven't
+// reached the error handler yet.
+func HTTPStatus(err error) int {
+	var ae *Error
+	if errors.As(err, &ae) {
+		return ae.Status
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// WithStatus overrides the http status of the code
+func (e *Error) WithStatus(status int) *Error {
+	e.Status = status
+	return e
+}
+
+// WithLevel overrides the level the error is logged at
+func (e *Error) WithLevel(level zapcore.Level) *Error {
+	e.Level = level
+	return e
+}
+
+// WithField adds a problem with a single input
+func (e *Error) WithField(field, message string) *Error {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.cause == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Message, e.cause)
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// StackTrace is where the error was created so log.Callers can point at it
+func (e *Error) StackTrace() errors.StackTrace {
+	st := make(errors.StackTrace, len(e.stack))
+	for i, pc := range e.stack {
+		st[i] = errors.Frame(pc)
+	}
+	return st
+}
+
+// defaultLevel logs server errors as errors. Clients getting something wrong is expected, and
+// unauthenticated requests are so common (expired sessions, probes) they are only debug.
+func defaultLevel(status int) zapcore.Level {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return zapcore.ErrorLevel
+	case status == http.StatusUnauthorized:
+		return zapcore.DebugLevel
+	default:
+		return zapcore.WarnLevel
+	}
+}
+
+// codeForStatus is the code of a status, falling back to the snake cased status text
+func codeForStatus(status int) Code {
+	for code, s := range statuses {
+		if s == status {
+			return code
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return Code(strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"))
+}
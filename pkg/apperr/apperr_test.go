@@ -0,0 +1,89 @@
+package apperr
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestError(t *testing.T) {
+	type tc struct {
+		err           *Error
+		expectCode    Code
+		expectStatus  int
+		expectLevel   zapcore.Level
+		expectMessage string
+	}
+
+	tests := map[string]tc{
+		"client errors": {
+			err:           New(CodeNotFound, "No such user"),
+			expectCode:    CodeNotFound,
+			expectStatus:  http.StatusNotFound,
+			expectLevel:   zapcore.WarnLevel,
+			expectMessage: "No such user",
+		},
+		"unauthenticated is only debug": {
+			err:           New(CodeUnauthenticated, "Sign in"),
+			expectCode:    CodeUnauthenticated,
+			expectStatus:  http.StatusUnauthorized,
+			expectLevel:   zapcore.DebugLevel,
+			expectMessage: "Sign in",
+		},
+		"wrapped causes": {
+			err:           Wrap(errors.New("connection refused"), CodeUnavailable, "Try again later"),
+			expectCode:    CodeUnavailable,
+			expectStatus:  http.StatusServiceUnavailable,
+			expectLevel:   zapcore.ErrorLevel,
+			expectMessage: "Try again later: connection refused",
+		},
+		"overrides": {
+			err:           New(CodeConflict, "Taken").WithStatus(http.StatusUnprocessableEntity).WithLevel(zapcore.InfoLevel),
+			expectCode:    CodeConflict,
+			expectStatus:  http.StatusUnprocessableEntity,
+			expectLevel:   zapcore.InfoLevel,
+			expectMessage: "Taken",
+		},
+		"from known statuses": {
+			err:           FromStatus(http.StatusForbidden, "Forbidden", nil),
+			expectCode:    CodePermissionDenied,
+			expectStatus:  http.StatusForbidden,
+			expectLevel:   zapcore.WarnLevel,
+			expectMessage: "Forbidden",
+		},
+		"from other statuses": {
+			err:           FromStatus(http.StatusMethodNotAllowed, "Method Not Allowed", nil),
+			expectCode:    Code("method_not_allowed"),
+			expectStatus:  http.StatusMethodNotAllowed,
+			expectLevel:   zapcore.WarnLevel,
+			expectMessage: "Method Not Allowed",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expectCode, tc.err.Code)
+			assert.Equal(t, tc.expectStatus, tc.err.Status)
+			assert.Equal(t, tc.expectLevel, tc.err.Level)
+			assert.Equal(t, tc.expectMessage, tc.err.Error())
+		})
+	}
+}
+
+func TestStack(t *testing.T) {
+	// the error points at where it was created
+	d := log.Inspect(New(CodeInternal, "boom"))
+	assert.Equal(t, "TestStack", d.Func)
+
+	// unless the cause knows better
+	cause := errors.New("connection refused")
+	d = log.Inspect(Wrap(cause, CodeUnavailable, "Try again later"))
+	assert.Equal(t, []string{"Try again later", "connection refused"}, d.Messages)
+	assert.Equal(t, log.Inspect(cause).Caller, d.Caller)
+	assert.True(t, errors.Is(Wrap(cause, CodeUnavailable, ""), cause))
+}
@@ -1,20 +1,186 @@
 package auth
 
 import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
-// Middleware is a simple middleware that checks the request for authentication
-func Middleware() echo.MiddlewareFunc {
+// ErrNoCredentials is returned by authenticators when the request doesn't carry credentials they
+// understand, so the next authenticator in the chain gets to try
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator identifies the principal of a request
+type Authenticator interface {
+	// Authenticate returns the principal of the request or ErrNoCredentials. Any other error
+	// rejects the request, so treat credentials that are merely stale (e.g. an expired session
+	// cookie) as missing.
+	Authenticate(c echo.Context) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator
+type AuthenticatorFunc func(c echo.Context) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(c echo.Context) (*Principal, error) {
+	return f(c)
+}
+
+// Challenger is implemented by authenticators that tell clients how to authenticate with a
+// WWW-Authenticate header, e.g. basic auth so browsers prompt for a password
+type Challenger interface {
+	Challenge() string
+}
+
+// ErrorChallenger is implemented by challengers that tell clients why their credentials were
+// rejected, e.g. error="invalid_token" for bearer tokens (RFC 6750)
+type ErrorChallenger interface {
+	Challenger
+	ChallengeError(err error) string
+}
+
+// Policy is what a group of routes requires of the principal
+type Policy int
+
+const (
+	// Optional identifies the principal if there is one, anonymous requests are let through
+	Optional Policy = iota
+	// Required rejects anonymous requests
+	Required
+	// AnonymousOnly redirects authenticated requests home, e.g. for the sign in page
+	AnonymousOnly
+)
+
+// Chain tries authenticators in order until one identifies the principal
+type Chain struct {
+	authenticators []Authenticator
+}
+
+// NewChain creates a chain of the authenticators. The first one to find credentials decides.
+func NewChain(authenticators ...Authenticator) *Chain {
+	return &Chain{authenticators: authenticators}
+}
+
+// Middleware authenticates requests and enforces the policy. The principal is stored in the
+// request context (see PrincipalFromContext) and the request logger is tagged with it. Groups
+// can be nested: a request that already has a principal is not authenticated again.
+func (ch *Chain) Middleware(policy Policy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p, ok := PrincipalFromContext(c.Request().Context())
+			if !ok {
+				var err error
+				var rejectedBy int
+				p, rejectedBy, err = ch.authenticate(c)
+				if err != nil {
+					ch.challenge(c, rejectedBy, err)
+					return err
+				}
+			}
+
+			switch {
+			case policy == Required && p == nil:
+				ch.challenge(c, -1, nil)
+				return apperr.New(apperr.CodeUnauthenticated, "Sign in to continue")
+			case policy == AnonymousOnly && p != nil:
+				return c.Redirect(http.StatusSeeOther, "/")
+			}
+
+			if p != nil && !ok {
+				ctx := NewContext(c.Request().Context(), p)
+				ctx = log.NewContext(ctx, log.FromContext(ctx).With(
+					zap.String("principal", p.ID),
+					zap.String("auth_method", string(p.Method)),
+				))
+				c.SetRequest(c.Request().WithContext(ctx))
+			}
+			return next(c)
+		}
+	}
+}
+
+// authenticate returns the principal of the request. If credentials are rejected it also returns
+// the index of the authenticator that rejected them.
+func (ch *Chain) authenticate(c echo.Context) (*Principal, int, error) {
+	for i, a := range ch.authenticators {
+		p, err := a.Authenticate(c)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			var ae *apperr.Error
+			if errors.As(err, &ae) {
+				return nil, i, err
+			}
+			return nil, i, apperr.Wrap(err, apperr.CodeUnauthenticated, "Invalid credentials")
+		}
+		if p != nil {
+			return p, -1, nil
+		}
+	}
+	return nil, -1, nil
+}
+
+// challenge tells the client every way it could authenticate. The authenticator that rejected
+// the credentials, if any, also says why.
+func (ch *Chain) challenge(c echo.Context, rejectedBy int, err error) {
+	var challenges []string
+	for i, a := range ch.authenticators {
+		if challenger, ok := a.(ErrorChallenger); ok && i == rejectedBy {
+			challenges = append(challenges, challenger.ChallengeError(err))
+		} else if challenger, ok := a.(Challenger); ok {
+			challenges = append(challenges, challenger.Challenge())
+		}
+	}
+	// several authenticators can accept the same scheme, e.g. bearer tokens that are JWTs or API keys
+	for i, challenge := range challenges {
+		if !slices.Contains(challenges[:i], challenge) {
+			c.Response().Header().Add(echo.HeaderWWWAuthenticate, challenge)
+		}
+	}
+}
+
+// RequireRole only lets principals with the role through. Use it after a chain's middleware.
+func RequireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p, ok := PrincipalFromContext(c.Request().Context())
+			if !ok {
+				return apperr.New(apperr.CodeUnauthenticated, "Sign in to continue")
+			}
+			if !p.HasRole(role) {
+				return apperr.New(apperr.CodePermissionDenied, "You don't have access to this")
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireScope only lets principals that may act within the scope through, e.g. API keys issued
+// for it. Use it after a chain's middleware.
+func RequireScope(scope string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) (err error) {
-			// obviously this is not real authentication and is just illustrative of what you can do here
-			username, _, ok := c.Request().BasicAuth()
-			if ok && username == "reject" {
-				return echo.ErrUnauthorized.SetInternal(errors.Errorf("user; %s is not authorized", username))
+		return func(c echo.Context) error {
+			p, ok := PrincipalFromContext(c.Request().Context())
+			if !ok {
+				return apperr.New(apperr.CodeUnauthenticated, "Sign in to continue")
+			}
+			if !p.HasScope(scope) {
+				return apperr.New(apperr.CodePermissionDenied, fmt.Sprintf("This needs the %s scope", scope))
 			}
 			return next(c)
 		}
 	}
 }
+
+// Middleware identifies callers that presented a verified client certificate (mutual tls) and
+// lets everyone else through anonymously. Build a Chain for any other kind of credentials.
+func Middleware() echo.MiddlewareFunc {
+	return NewChain(ClientCerts()).Middleware(Optional)
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	chain := NewChain(
+		Bearer(func(ctx context.Context, token string) (*Principal, error) {
+			if token != "good-token" {
+				return nil, errors.New("unknown token")
+			}
+			return &Principal{ID: "svc", Method: MethodBearer}, nil
+		}),
+		APIKey("X-Api-Key", func(ctx context.Context, key string) (*Principal, error) {
+			return &Principal{ID: "key-" + key, Method: MethodAPIKey}, nil
+		}),
+		SessionCookie("session", func(ctx context.Context, session string) (*Principal, error) {
+			if session == "expired" {
+				return nil, ErrNoCredentials
+			}
+			return &Principal{ID: "alice", Roles: []string{RoleAdmin}, Method: MethodSession}, nil
+		}),
+		Basic("test", StaticCredentials("ops", "secret", RoleAdmin)),
+	)
+
+	type tc struct {
+		policy          Policy
+		role            string
+		setup           func(r *http.Request)
+		expectPrincipal string
+		expectCode      apperr.Code
+		expectRedirect  bool
+		expectChallenge bool
+	}
+
+	tests := map[string]tc{
+		"optional lets anonymous requests through": {
+			policy: Optional,
+		},
+		"required rejects anonymous requests": {
+			policy:          Required,
+			expectCode:      apperr.CodeUnauthenticated,
+			expectChallenge: true,
+		},
+		"bearer token": {
+			policy:          Required,
+			setup:           func(r *http.Request) { r.Header.Set("Authorization", "Bearer good-token") },
+			expectPrincipal: "svc",
+		},
+		"bad bearer token is rejected even if optional": {
+			policy:          Optional,
+			setup:           func(r *http.Request) { r.Header.Set("Authorization", "Bearer bad-token") },
+			expectCode:      apperr.CodeUnauthenticated,
+			expectChallenge: true,
+		},
+		"api key": {
+			policy:          Required,
+			setup:           func(r *http.Request) { r.Header.Set("X-Api-Key", "123") },
+			expectPrincipal: "key-123",
+		},
+		"session cookie": {
+			policy:          Required,
+			setup:           func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "abc"}) },
+			expectPrincipal: "alice",
+		},
+		"expired session is anonymous": {
+			policy: Optional,
+			setup:  func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "expired"}) },
+		},
+		"basic auth": {
+			policy:          Required,
+			setup:           func(r *http.Request) { r.SetBasicAuth("ops", "secret") },
+			expectPrincipal: "basic:ops",
+		},
+		"wrong basic auth": {
+			policy:          Required,
+			setup:           func(r *http.Request) { r.SetBasicAuth("ops", "guess") },
+			expectCode:      apperr.CodeUnauthenticated,
+			expectChallenge: true,
+		},
+		"anonymous only redirects principals": {
+			policy:         AnonymousOnly,
+			setup:          func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "abc"}) },
+			expectRedirect: true,
+		},
+		"role": {
+			policy:          Required,
+			role:            RoleAdmin,
+			setup:           func(r *http.Request) { r.SetBasicAuth("ops", "secret") },
+			expectPrincipal: "basic:ops",
+		},
+		"missing role": {
+			policy:     Required,
+			role:       RoleAdmin,
+			setup:      func(r *http.Request) { r.Header.Set("X-Api-Key", "123") },
+			expectCode: apperr.CodePermissionDenied,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.setup != nil {
+				tc.setup(req)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+
+			var got *Principal
+			h := func(c echo.Context) error {
+				got, _ = PrincipalFromContext(c.Request().Context())
+				return nil
+			}
+			if tc.role != "" {
+				h = RequireRole(tc.role)(h)
+			}
+			err := chain.Middleware(tc.policy)(h)(c)
+
+			if tc.expectCode != "" {
+				var ae *apperr.Error
+				require.True(t, errors.As(err, &ae))
+				assert.Equal(t, tc.expectCode, ae.Code)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectChallenge, len(rec.Header().Values(echo.HeaderWWWAuthenticate)) > 0)
+			if tc.expectRedirect {
+				assert.Equal(t, http.StatusSeeOther, rec.Code)
+				assert.Nil(t, got)
+				return
+			}
+			if tc.expectPrincipal == "" {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.Equal(t, tc.expectPrincipal, got.ID)
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	type tc struct {
+		principal *Principal
+		expect    bool
+	}
+
+	tests := map[string]tc{
+		"in scope":     {principal: &Principal{Scopes: []string{"orders:read"}}, expect: true},
+		"other scope":  {principal: &Principal{Scopes: []string{"orders:write"}}},
+		"all scopes":   {principal: &Principal{AllScopes: true}, expect: true},
+		"nil scopes":   {principal: &Principal{}},
+		"empty scopes": {principal: &Principal{Scopes: []string{}}},
+		"no principal": {},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, tc.principal.HasScope("orders:read"))
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type contextKey string
+
+const clientCertKey = contextKey("client-cert")
+
+// ClientCert is the identity of a caller that authenticated with a verified client certificate
+type ClientCert struct {
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	// SPIFFEID is the spiffe:// URI SAN if the certificate has one
+	SPIFFEID string
+}
+
+// ClientCertFromContext returns the verified client certificate identity for the request if the
+// caller presented one
+func ClientCertFromContext(ctx context.Context) (cert *ClientCert, ok bool) {
+	cert, ok = ctx.Value(clientCertKey).(*ClientCert)
+	return cert, ok
+}
+
+// clientCertFromRequest extracts the identity from the verified peer certificate. Certificates are
+// only trusted if the tls stack verified them against the client CA bundle, so in the "request"
+// client auth mode an unverified certificate is ignored.
+func clientCertFromRequest(r *http.Request) (cert *ClientCert, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return cert, false
+	}
+	return newClientCert(r.TLS.VerifiedChains[0][0]), true
+}
+
+func newClientCert(leaf *x509.Certificate) *ClientCert {
+	cert := &ClientCert{
+		CommonName:     leaf.Subject.CommonName,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+	}
+	for _, u := range leaf.URIs {
+		cert.URIs = append(cert.URIs, u.String())
+		if u.Scheme == "spiffe" && cert.SPIFFEID == "" {
+			cert.SPIFFEID = u.String()
+		}
+	}
+	return cert
+}
+
+// ClientCerts authenticates callers with a verified client certificate. The principal id is the
+// SPIFFE id of the certificate or else its common name, prefixed with cert: so it can't collide
+// with the ids of other kinds of principals. The principal is in the scopes. Handlers can read
+// the whole certificate with ClientCertFromContext.
+func ClientCerts(scopes ...string) Authenticator {
+	return AuthenticatorFunc(func(c echo.Context) (*Principal, error) {
+		cert, ok := clientCertFromRequest(c.Request())
+		if !ok {
+			return nil, ErrNoCredentials
+		}
+		c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), clientCertKey, cert)))
+
+		id := cert.SPIFFEID
+		if id == "" {
+			id = cert.CommonName
+		}
+		return &Principal{
+			ID:     "cert:" + id,
+			Name:   cert.CommonName,
+			Scopes: scopes,
+			Method: MethodClientCert,
+		}, nil
+	})
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareClientCert(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/ns/default/sa/billing")
+	leaf := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "billing"},
+		DNSNames: []string{"billing.internal"},
+		URIs:     []*url.URL{spiffe},
+	}
+
+	type tc struct {
+		tls        *tls.ConnectionState
+		expected   *ClientCert
+		expectedID string
+	}
+
+	tests := map[string]tc{
+		"plain http": {},
+		"unverified certificate": {
+			tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}},
+		},
+		"verified certificate": {
+			tls: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{leaf},
+				VerifiedChains:   [][]*x509.Certificate{{leaf}},
+			},
+			expected: &ClientCert{
+				CommonName: "billing",
+				DNSNames:   []string{"billing.internal"},
+				URIs:       []string{"spiffe://example.org/ns/default/sa/billing"},
+				SPIFFEID:   "spiffe://example.org/ns/default/sa/billing",
+			},
+			expectedID: "cert:spiffe://example.org/ns/default/sa/billing",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.TLS = tc.tls
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			var (
+				got *ClientCert
+				p   *Principal
+			)
+			err := NewChain(ClientCerts("orders:read")).Middleware(Optional)(func(c echo.Context) error {
+				got, _ = ClientCertFromContext(c.Request().Context())
+				p, _ = PrincipalFromContext(c.Request().Context())
+				return nil
+			})(c)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+			if tc.expectedID == "" {
+				assert.Nil(t, p)
+				return
+			}
+			assert.Equal(t, tc.expectedID, p.ID)
+			assert.True(t, p.HasScope("orders:read"))
+			assert.False(t, p.HasScope("orders:write"))
+		})
+	}
+}
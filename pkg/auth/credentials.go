@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// Basic authenticates requests with http basic auth. verify returns the principal for the
+// username and password or an error if they are wrong.
+func Basic(realm string, verify func(ctx context.Context, username, password string) (*Principal, error)) Authenticator {
+	return &basic{realm: realm, verify: verify}
+}
+
+type basic struct {
+	realm  string
+	verify func(ctx context.Context, username, password string) (*Principal, error)
+}
+
+func (b *basic) Authenticate(c echo.Context) (*Principal, error) {
+	username, password, ok := c.Request().BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	return b.verify(c.Request().Context(), username, password)
+}
+
+func (b *basic) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", b.realm)
+}
+
+// StaticCredentials verifies basic auth against a single username and password, e.g. for an
+// operator account configured from the env. The principal id is the username prefixed with
+// basic: and the principal gets the roles but no scopes.
+func StaticCredentials(username, password string, roles ...string) func(ctx context.Context, username, password string) (*Principal, error) {
+	return func(ctx context.Context, u, p string) (*Principal, error) {
+		// compare both in constant time so the response time doesn't leak which one was wrong
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !userOK || !passOK {
+			return nil, errors.Errorf("wrong username or password | username=[%s]", u)
+		}
+		return &Principal{ID: "basic:" + username, Name: username, Roles: roles, Method: MethodBasic}, nil
+	}
+}
+
+// Bearer authenticates requests with a token in the Authorization header. verify returns the
+// principal the token belongs to.
+func Bearer(verify func(ctx context.Context, token string) (*Principal, error)) Authenticator {
+	return &bearer{verify: verify}
+}
+
+type bearer struct {
+	verify func(ctx context.Context, token string) (*Principal, error)
+}
+
+func (b *bearer) Authenticate(c echo.Context) (*Principal, error) {
+	scheme, token, ok := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return nil, ErrNoCredentials
+	}
+	return b.verify(c.Request().Context(), token)
+}
+
+func (b *bearer) Challenge() string {
+	return "Bearer"
+}
+
+func (b *bearer) ChallengeError(err error) string {
+	var ae *apperr.Error
+	if errors.As(err, &ae) && ae.Code != apperr.CodeUnauthenticated {
+		return b.Challenge()
+	}
+	return `Bearer error="invalid_token"`
+}
+
+// APIKey authenticates requests with a key in the header, e.g. X-Api-Key. verify returns the
+// principal the key belongs to.
+func APIKey(header string, verify func(ctx context.Context, key string) (*Principal, error)) Authenticator {
+	return AuthenticatorFunc(func(c echo.Context) (*Principal, error) {
+		key := c.Request().Header.Get(header)
+		if key == "" {
+			return nil, ErrNoCredentials
+		}
+		return verify(c.Request().Context(), key)
+	})
+}
+
+// SessionCookie authenticates requests with the session in the cookie. lookup returns the
+// principal of the session, or ErrNoCredentials if it expired so the request continues anonymously.
+func SessionCookie(name string, lookup func(ctx context.Context, session string) (*Principal, error)) Authenticator {
+	return AuthenticatorFunc(func(c echo.Context) (*Principal, error) {
+		cookie, err := c.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return nil, ErrNoCredentials
+		}
+		return lookup(c.Request().Context(), cookie.Value)
+	})
+}
@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// minRefetchInterval stops tokens with made up key ids from making us hammer the key server
+	minRefetchInterval = time.Minute
+	// defaultKeySetTTL is how long keys are cached when the key server doesn't say with Cache-Control
+	defaultKeySetTTL = time.Hour
+	// maxKeySetTTL bounds long cache lifetimes so removed keys stop being trusted eventually
+	maxKeySetTTL = 24 * time.Hour
+	// staleKeySetGrace is how long past their expiry cached keys are still used while the key
+	// server is down. After that they are dropped, so removed keys stop being trusted even if
+	// the key server never comes back.
+	staleKeySetGrace = 24 * time.Hour
+)
+
+// KeySet is the JSON Web Key Set (JWKS) of an issuer that signs tokens. Keys are fetched on first
+// use and cached for as long as the Cache-Control header of the response allows. They are fetched
+// again early when a token is signed by a key we haven't seen, e.g. after the issuer rotated its
+// keys. If the key server can't be reached the cached keys are used for up to staleKeySetGrace
+// past their expiry.
+type KeySet struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]jwk
+	fetched time.Time
+	expires time.Time
+	// refreshed is closed when the fetch in flight is done, it is nil without one. Requests
+	// waiting for keys share the fetch, known keys are served from the cache meanwhile.
+	refreshed chan struct{}
+	// fetchErr is why the last fetch failed
+	fetchErr error
+}
+
+// jwk is a single public key of a key set
+type jwk struct {
+	ID  string
+	Alg string
+	Key crypto.PublicKey
+}
+
+// NewKeySet creates a key set fetched from url with client. Give the client a timeout, fetches
+// are shared by requests so they don't end with the request that started them.
+func NewKeySet(url string, client *http.Client) *KeySet {
+	return &KeySet{url: url, client: client}
+}
+
+// ParseKeySet creates a static key set from a JWKS document, e.g. for an issuer that doesn't
+// publish its keys. Rotate the keys by deploying a new document.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	keys, err := parseKeySet(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key set has no signing keys")
+	}
+	return &KeySet{keys: keys}, nil
+}
+
+// key returns the key with the id. Tokens without a key id are accepted if the set has a single key.
+func (ks *KeySet) key(ctx context.Context, kid string) (jwk, error) {
+	ks.mu.Lock()
+	now := time.Now()
+	ks.dropStale(now)
+	k, ok := ks.lookup(kid)
+	switch {
+	case ok && (ks.url == "" || now.Before(ks.expires)):
+		ks.mu.Unlock()
+		return k, nil
+	case ks.url == "":
+		ks.mu.Unlock()
+		return jwk{}, errors.Errorf("unknown signing key | kid=[%s]", kid)
+	case ok && ks.refreshed != nil:
+		// someone else is fetching the keys, keep using the one we have
+		ks.mu.Unlock()
+		return k, nil
+	case ks.refreshed == nil && now.Sub(ks.fetched) < minRefetchInterval:
+		defer ks.mu.Unlock()
+		if ok {
+			return k, nil
+		}
+		return jwk{}, ks.missing(kid)
+	}
+
+	refreshed := ks.refreshed
+	if refreshed == nil {
+		// even failures count so an unreachable key server isn't retried on every request
+		ks.fetched = now
+		refreshed = make(chan struct{})
+		ks.refreshed = refreshed
+		// the fetch is shared, so it doesn't end with the request that started it
+		go ks.refresh(context.WithoutCancel(ctx), refreshed)
+	}
+	ks.mu.Unlock()
+
+	select {
+	case <-refreshed:
+	case <-ctx.Done():
+		return jwk{}, errors.Wrap(ctx.Err(), "waiting for signing keys")
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if k, ok := ks.lookup(kid); ok {
+		return k, nil
+	}
+	return jwk{}, ks.missing(kid)
+}
+
+// missing is the error for a key that isn't in the set. Without any keys the key server is down
+// rather than the token being wrong.
+func (ks *KeySet) missing(kid string) error {
+	if ks.keys == nil && ks.fetchErr != nil {
+		return apperr.Wrap(ks.fetchErr, apperr.CodeUnavailable, "Signing keys are unavailable right now, try again later")
+	}
+	return errors.Errorf("unknown signing key | kid=[%s]", kid)
+}
+
+// dropStale drops fetched keys that expired more than staleKeySetGrace ago. Static key sets
+// never expire.
+func (ks *KeySet) dropStale(now time.Time) {
+	if ks.url != "" && ks.keys != nil && now.After(ks.expires.Add(staleKeySetGrace)) {
+		ks.keys = nil
+	}
+}
+
+func (ks *KeySet) lookup(kid string) (jwk, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+// refresh fetches the keys and closes refreshed once they are in place
+func (ks *KeySet) refresh(ctx context.Context, refreshed chan struct{}) {
+	keys, ttl, err := ks.fetch(ctx)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	defer close(refreshed)
+	ks.refreshed = nil
+	ks.fetchErr = err
+	if err != nil {
+		if ks.keys == nil {
+			return
+		}
+		ks.dropStale(time.Now())
+		if ks.keys == nil {
+			log.FromContext(ctx).Error("dropped cached signing keys, the key server has been down for too long", zap.String("url", ks.url), zap.Error(err))
+			return
+		}
+		// keep verifying with the keys we have rather than failing every request while the key
+		// server is down
+		log.FromContext(ctx).Warn("using cached signing keys", zap.String("url", ks.url), zap.Error(err))
+		return
+	}
+	ks.keys = keys
+	ks.expires = ks.fetched.Add(ttl)
+}
+
+// fetch gets the keys from the key server along with how long they may be cached
+func (ks *KeySet) fetch(ctx context.Context) (map[string]jwk, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "creating jwks request | url=[%s]", ks.url)
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "fetching jwks | url=[%s]", ks.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("fetching jwks | url=[%s] status=[%d]", ks.url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "reading jwks | url=[%s]", ks.url)
+	}
+	keys, err := parseKeySet(data)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "parsing jwks | url=[%s]", ks.url)
+	}
+	return keys, cacheTTL(resp.Header.Get("Cache-Control")), nil
+}
+
+// cacheTTL is how long a response may be cached according to its Cache-Control header
+func cacheTTL(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || seconds < 0 {
+				return defaultKeySetTTL
+			}
+			return min(time.Duration(seconds)*time.Second, maxKeySetTTL)
+		}
+	}
+	return defaultKeySetTTL
+}
+
+// parseKeySet parses a JWKS document into its signing keys by id
+func parseKeySet(data []byte) (map[string]jwk, error) {
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding jwks")
+	}
+
+	keys := map[string]jwk{}
+	for _, raw := range set.Keys {
+		k, ok, err := parseJWK(raw)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys[k.ID] = k
+		}
+	}
+	return keys, nil
+}
+
+// parseJWK parses an RSA, EC or Ed25519 public key. Keys of other types or for encryption are skipped.
+func parseJWK(raw json.RawMessage) (k jwk, ok bool, err error) {
+	var fields struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		return k, false, errors.Wrap(err, "decoding key")
+	}
+	if fields.Use != "" && fields.Use != "sig" {
+		return k, false, nil
+	}
+	k = jwk{ID: fields.Kid, Alg: fields.Alg}
+
+	switch fields.Kty {
+	case "RSA":
+		n, err := decodeBigInt(fields.N)
+		if err != nil {
+			return k, false, errors.Wrapf(err, "decoding modulus | kid=[%s]", fields.Kid)
+		}
+		e, err := decodeBigInt(fields.E)
+		if err != nil || !e.IsInt64() {
+			return k, false, errors.Errorf("invalid exponent | kid=[%s]", fields.Kid)
+		}
+		k.Key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch fields.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return k, false, nil
+		}
+		x, err := decodeBigInt(fields.X)
+		if err != nil {
+			return k, false, errors.Wrapf(err, "decoding x | kid=[%s]", fields.Kid)
+		}
+		y, err := decodeBigInt(fields.Y)
+		if err != nil {
+			return k, false, errors.Wrapf(err, "decoding y | kid=[%s]", fields.Kid)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		// converting checks that the point is on the curve
+		_, err = pub.ECDH()
+		if err != nil {
+			return k, false, errors.Wrapf(err, "invalid point | kid=[%s]", fields.Kid)
+		}
+		k.Key = pub
+	case "OKP":
+		if fields.Crv != "Ed25519" {
+			return k, false, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(fields.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return k, false, errors.Errorf("invalid ed25519 key | kid=[%s]", fields.Kid)
+		}
+		k.Key = ed25519.PublicKey(x)
+	default:
+		return k, false, nil
+	}
+	return k, true, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
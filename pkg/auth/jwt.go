@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // register the hashes of the signing algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clockSkew is how far the clocks of issuers and us may disagree when checking expiry
+const clockSkew = time.Minute
+
+// Claims are the claims of a verified JSON Web Token
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	Expiry    time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	// Raw is every claim, e.g. for custom claims like roles or groups
+	Raw map[string]any
+}
+
+// String returns the claim if it is a string
+func (c Claims) String(name string) string {
+	s, _ := c.Raw[name].(string)
+	return s
+}
+
+// Strings returns the claim if it is a string or an array of strings
+func (c Claims) Strings(name string) []string {
+	switch v := c.Raw[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// signingHashes are the algorithms we verify and the hashes they sign. EdDSA signs the whole
+// message. Symmetric algorithms and "none" are never accepted since the keys come from a public
+// key set.
+var signingHashes = map[string]crypto.Hash{
+	"EdDSA": 0,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// ecdsaCurves are the curves the ES algorithms sign with
+var ecdsaCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// verifyJWT checks the signature of the compact serialized token against the key set and returns
+// its claims. algs are the allowed signing algorithms. It doesn't validate the claims, see
+// Claims.validate.
+func verifyJWT(ctx context.Context, token string, keys *KeySet, algs []string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return Claims{}, errors.Wrap(err, "decoding header")
+	}
+	if len(header.Crit) > 0 {
+		return Claims{}, errors.Errorf("unsupported critical header | crit=%v", header.Crit)
+	}
+	hash, ok := signingHashes[header.Alg]
+	if !ok || !slices.Contains(algs, header.Alg) {
+		return Claims{}, errors.Errorf("signing algorithm not allowed | alg=[%s]", header.Alg)
+	}
+
+	k, err := keys.key(ctx, header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+	if k.Alg != "" && k.Alg != header.Alg {
+		return Claims{}, errors.Errorf("key is for another algorithm | alg=[%s] key_alg=[%s]", header.Alg, k.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, errors.Wrap(err, "decoding signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		signed = h.Sum(nil)
+	}
+	err = verifySignature(header.Alg, k.Key, hash, signed, sig)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	var raw map[string]any
+	err = decodeSegment(parts[1], &raw)
+	if err != nil {
+		return Claims{}, errors.Wrap(err, "decoding claims")
+	}
+	return newClaims(raw)
+}
+
+// verifySignature checks the signature over the digest of the signed part, or over the signed
+// part itself for EdDSA
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	switch alg[:2] {
+	case "Ed":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.Errorf("key doesn't match the algorithm | alg=[%s]", alg)
+		}
+		if !ed25519.Verify(pub, digest, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.Errorf("key doesn't match the algorithm | alg=[%s]", alg)
+		}
+		if alg[:2] == "RS" {
+			return errors.Wrap(rsa.VerifyPKCS1v15(pub, hash, digest, sig), "invalid signature")
+		}
+		return errors.Wrap(rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}), "invalid signature")
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.Errorf("key doesn't match the algorithm | alg=[%s]", alg)
+		}
+		if ecdsaCurves[alg] != pub.Curve.Params().Name {
+			return errors.Errorf("key doesn't match the algorithm | alg=[%s] curve=[%s]", alg, pub.Curve.Params().Name)
+		}
+		// the signature is r and s as fixed size big endian integers
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.Errorf("unsupported algorithm | alg=[%s]", alg)
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func newClaims(raw map[string]any) (c Claims, err error) {
+	c = Claims{Raw: raw}
+	c.Issuer, _ = raw["iss"].(string)
+	c.Subject, _ = raw["sub"].(string)
+	c.Audience = c.Strings("aud")
+
+	for name, t := range map[string]*time.Time{"exp": &c.Expiry, "nbf": &c.NotBefore, "iat": &c.IssuedAt} {
+		v, ok := raw[name]
+		if !ok {
+			continue
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			return c, errors.Errorf("claim is not a number | claim=[%s]", name)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return c, errors.Wrapf(err, "parsing claim | claim=[%s]", name)
+		}
+		*t = time.Unix(int64(f), 0)
+	}
+	return c, nil
+}
+
+// validate checks the registered claims: the token comes from the issuer, is meant for the
+// audience and is currently valid. Tokens have to expire.
+func (c Claims) validate(issuer, audience string, now time.Time) error {
+	if c.Issuer != issuer {
+		return errors.Errorf("wrong issuer | iss=[%s]", c.Issuer)
+	}
+	if !slices.Contains(c.Audience, audience) {
+		return errors.Errorf("wrong audience | aud=%v", c.Audience)
+	}
+	if c.Expiry.IsZero() {
+		return errors.New("token doesn't expire")
+	}
+	if now.After(c.Expiry.Add(clockSkew)) {
+		return errors.Errorf("token expired | exp=[%s]", c.Expiry.Format(time.RFC3339))
+	}
+	if !c.NotBefore.IsZero() && now.Add(clockSkew).Before(c.NotBefore) {
+		return errors.Errorf("token not valid yet | nbf=[%s]", c.NotBefore.Format(time.RFC3339))
+	}
+	if c.Subject == "" {
+		return errors.New("token has no subject")
+	}
+	return nil
+}
+
+// JWTConfig configures verifying JWT bearer tokens
+type JWTConfig struct {
+	// Issuer and Audience have to match the iss and aud claims of tokens
+	Issuer   string
+	Audience string
+	// Keys are the keys of the issuer, from NewKeySet or ParseKeySet
+	Keys *KeySet
+	// Algorithms are the accepted signing algorithms. Defaults to RS256, ES256 and EdDSA.
+	Algorithms []string
+	// RolesClaim is the claim listing the roles of the caller, e.g. roles. Roles maps its values
+	// to our roles and is required with it, values it doesn't map are ignored so the issuer can't
+	// grant our roles by name.
+	RolesClaim string
+	Roles      map[string]string
+	// Principal replaces mapping the claims of verified tokens to the principal
+	Principal func(claims Claims) (*Principal, error)
+}
+
+// JWT authenticates requests with JWT bearer tokens from the issuer, e.g. for mobile and command
+// line clients calling the api. Tokens have to be signed by one of the keys and be currently valid
+// for the audience.
+func JWT(config JWTConfig) (Authenticator, error) {
+	switch {
+	case config.Issuer == "":
+		return nil, errors.New("jwt issuer is required")
+	case config.Audience == "":
+		return nil, errors.New("jwt audience is required")
+	case config.Keys == nil:
+		return nil, errors.New("jwt keys are required")
+	case config.RolesClaim != "" && len(config.Roles) == 0 && config.Principal == nil:
+		return nil, errors.New("jwt roles claim needs a roles mapping")
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = []string{"RS256", "ES256", "EdDSA"}
+	}
+	for _, alg := range config.Algorithms {
+		if _, ok := signingHashes[alg]; !ok {
+			return nil, errors.Errorf("unsupported jwt algorithm | alg=[%s]", alg)
+		}
+	}
+	if config.Principal == nil {
+		config.Principal = config.principal
+	}
+	return &bearer{verify: config.verify}, nil
+}
+
+func (j JWTConfig) verify(ctx context.Context, token string) (*Principal, error) {
+	claims, err := verifyJWT(ctx, token, j.Keys, j.Algorithms)
+	if err != nil {
+		return nil, errors.Wrap(err, "verifying bearer token")
+	}
+	err = claims.validate(j.Issuer, j.Audience, time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "validating bearer token")
+	}
+	return j.Principal(claims)
+}
+
+// principal maps the subject, name, scopes and roles of the token to the principal. The id is
+// scoped to the issuer since subjects are only unique per issuer. The token can only do what the
+// scopes it was issued with allow.
+func (j JWTConfig) principal(claims Claims) (*Principal, error) {
+	p := &Principal{
+		ID:     claims.Issuer + ":" + claims.Subject,
+		Name:   displayName(claims),
+		Scopes: tokenScopes(claims),
+		Method: MethodBearer,
+	}
+	if j.RolesClaim == "" {
+		return p, nil
+	}
+	for _, value := range claims.Strings(j.RolesClaim) {
+		role, ok := j.Roles[value]
+		if ok && !slices.Contains(p.Roles, role) {
+			p.Roles = append(p.Roles, role)
+		}
+	}
+	return p, nil
+}
+
+// tokenScopes are the OAuth scopes of the token, from the space separated scope claim or the scp
+// claim some issuers use instead
+func tokenScopes(claims Claims) []string {
+	var scopes []string
+	for _, name := range []string{"scope", "scp"} {
+		for _, value := range claims.Strings(name) {
+			for _, scope := range strings.Fields(value) {
+				if !slices.Contains(scopes, scope) {
+					scopes = append(scopes, scope)
+				}
+			}
+		}
+	}
+	return scopes
+}
+
+// displayName is the first of the standard claims naming the user
+func displayName(claims Claims) string {
+	for _, name := range []string{"name", "preferred_username", "email"} {
+		if s := claims.String(name); s != "" {
+			return s
+		}
+	}
+	return ""
+}
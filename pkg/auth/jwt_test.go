@@ -0,0 +1,328 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/auth/oidctest"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWT(t *testing.T) {
+	idp := oidctest.NewProvider("client", "secret")
+	defer idp.Close()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	static, err := ParseKeySet(mustJSON(t, map[string]any{"keys": []map[string]string{
+		{
+			"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y": base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(edPub)},
+	}}))
+	require.NoError(t, err)
+
+	signES256 := func(claims map[string]any) string {
+		signed := jwtSigningInput(t, map[string]string{"alg": "ES256", "kid": "ec"}, claims)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		require.NoError(t, err)
+		sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	signEdDSA := func(claims map[string]any) string {
+		signed := jwtSigningInput(t, map[string]string{"alg": "EdDSA", "kid": "ed"}, claims)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(edKey, []byte(signed)))
+	}
+	unsigned := func(claims map[string]any) string {
+		return jwtSigningInput(t, map[string]string{"alg": "none"}, claims) + "."
+	}
+
+	type tc struct {
+		static    bool
+		sign      func(claims map[string]any) string
+		tamper    func(claims map[string]any)
+		expectErr bool
+	}
+
+	tests := map[string]tc{
+		"RS256 from the jwks url": {
+			sign: idp.Sign,
+		},
+		"ES256 from a static key set": {
+			static: true,
+			sign:   signES256,
+		},
+		"EdDSA from a static key set": {
+			static: true,
+			sign:   signEdDSA,
+		},
+		"unsigned": {
+			sign:      unsigned,
+			expectErr: true,
+		},
+		"key of another issuer": {
+			sign:      signES256,
+			expectErr: true,
+		},
+		"wrong issuer": {
+			sign:      idp.Sign,
+			tamper:    func(claims map[string]any) { claims["iss"] = "https://other.example.com" },
+			expectErr: true,
+		},
+		"wrong audience": {
+			sign:      idp.Sign,
+			tamper:    func(claims map[string]any) { claims["aud"] = "other-api" },
+			expectErr: true,
+		},
+		"expired": {
+			sign:      idp.Sign,
+			tamper:    func(claims map[string]any) { claims["exp"] = time.Now().Add(-2 * clockSkew).Unix() },
+			expectErr: true,
+		},
+		"expired within the clock skew": {
+			sign:   idp.Sign,
+			tamper: func(claims map[string]any) { claims["exp"] = time.Now().Add(-clockSkew / 2).Unix() },
+		},
+		"not valid yet": {
+			sign:      idp.Sign,
+			tamper:    func(claims map[string]any) { claims["nbf"] = time.Now().Add(2 * clockSkew).Unix() },
+			expectErr: true,
+		},
+		"doesn't expire": {
+			sign:      idp.Sign,
+			tamper:    func(claims map[string]any) { delete(claims, "exp") },
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := JWTConfig{
+				Issuer:     idp.Issuer(),
+				Audience:   "api",
+				Keys:       NewKeySet(idp.URL+"/jwks", idp.Client()),
+				RolesClaim: "roles",
+				Roles:      map[string]string{"api-admin": RoleAdmin},
+			}
+			if tc.static {
+				config.Keys = static
+			}
+			authenticator, err := JWT(config)
+			require.NoError(t, err)
+
+			claims := map[string]any{
+				"iss":   idp.Issuer(),
+				"sub":   "cli-1",
+				"aud":   []string{"api", "other-api"},
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"name":  "CLI",
+				"roles": []string{"api-admin", "reader"},
+				"scope": "profile:read orders:read",
+				"scp":   []string{"orders:read", "orders:write"},
+			}
+			if tc.tamper != nil {
+				tc.tamper(claims)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+tc.sign(claims))
+			rec := httptest.NewRecorder()
+
+			var got *Principal
+			err = NewChain(authenticator).Middleware(Required)(func(c echo.Context) error {
+				got, _ = PrincipalFromContext(c.Request().Context())
+				return nil
+			})(echo.New().NewContext(req, rec))
+
+			if tc.expectErr {
+				var ae *apperr.Error
+				require.True(t, errors.As(err, &ae), "expected an apperr, got %v", err)
+				assert.Equal(t, apperr.CodeUnauthenticated, ae.Code)
+				assert.Equal(t, `Bearer error="invalid_token"`, rec.Header().Get(echo.HeaderWWWAuthenticate))
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, got)
+			assert.Equal(t, idp.Issuer()+":cli-1", got.ID)
+			assert.Equal(t, "CLI", got.Name)
+			assert.Equal(t, MethodBearer, got.Method)
+			assert.Equal(t, []string{RoleAdmin}, got.Roles)
+			assert.Equal(t, []string{"profile:read", "orders:read", "orders:write"}, got.Scopes)
+			assert.False(t, got.HasScope("orders:delete"))
+		})
+	}
+
+	// the issuer can't grant our roles by name
+	_, err = JWT(JWTConfig{Issuer: idp.Issuer(), Audience: "api", Keys: static, RolesClaim: "roles"})
+	assert.EqualError(t, err, "jwt roles claim needs a roles mapping")
+}
+
+func TestKeySet(t *testing.T) {
+	ecKey := func() *ecdsa.PrivateKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		return k
+	}
+	jwks := func(kid string, k *ecdsa.PrivateKey) []byte {
+		return mustJSON(t, map[string]any{"keys": []map[string]string{{
+			"kty": "EC", "kid": kid, "crv": "P-256", "use": "sig",
+			"x": base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+			"y": base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+		}}})
+	}
+
+	var (
+		body     atomic.Value
+		status   atomic.Int32
+		requests atomic.Int32
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(int(status.Load()))
+		_, _ = w.Write(body.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	status.Store(http.StatusOK)
+	body.Store(jwks("first", ecKey()))
+	ks := NewKeySet(srv.URL, srv.Client())
+	ctx := context.Background()
+
+	// the keys are cached for the max-age of the response
+	_, err := ks.key(ctx, "first")
+	require.NoError(t, err)
+	_, err = ks.key(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), ks.expires, time.Second)
+
+	// unknown keys are only looked for once a minute
+	body.Store(jwks("second", ecKey()))
+	_, err = ks.key(ctx, "second")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+
+	// rotated keys are picked up
+	ks.fetched = ks.fetched.Add(-minRefetchInterval)
+	_, err = ks.key(ctx, "second")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// expired keys are still used while the key server is down
+	status.Store(http.StatusInternalServerError)
+	ks.fetched = ks.fetched.Add(-time.Hour)
+	ks.expires = time.Now().Add(-time.Minute)
+	_, err = ks.key(ctx, "second")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+
+	// but not for longer than the grace period
+	ks.fetched = ks.fetched.Add(-time.Hour)
+	ks.expires = time.Now().Add(-staleKeySetGrace - time.Minute)
+	_, err = ks.key(ctx, "second")
+	var ae *apperr.Error
+	require.True(t, errors.As(err, &ae))
+	assert.Equal(t, apperr.CodeUnavailable, ae.Code)
+	assert.Equal(t, int32(4), requests.Load())
+
+	// without any keys it is unavailable rather than the token being wrong
+	_, err = NewKeySet(srv.URL, srv.Client()).key(ctx, "second")
+	require.True(t, errors.As(err, &ae))
+	assert.Equal(t, apperr.CodeUnavailable, ae.Code)
+}
+
+func TestKeySetConcurrentFetch(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	body := mustJSON(t, map[string]any{"keys": []map[string]string{{
+		"kty": "EC", "kid": "second", "crv": "P-256", "use": "sig",
+		"x": base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+	}}})
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	// the cached keys expired
+	ks := NewKeySet(srv.URL, srv.Client())
+	ks.keys = map[string]jwk{"first": {ID: "first"}}
+	ks.expires = time.Now().Add(-time.Minute)
+	ctx := context.Background()
+
+	// requests for the new key share a single fetch
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = ks.key(ctx, "second")
+		}()
+	}
+	require.Eventually(t, func() bool { return requests.Load() == 1 }, time.Second, time.Millisecond)
+
+	// the cached key is served while the fetch is in flight
+	_, err = ks.key(ctx, "first")
+	require.NoError(t, err)
+
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":                          defaultKeySetTTL,
+		"public, max-age=600":       10 * time.Minute,
+		"max-age=31536000":          maxKeySetTTL,
+		"no-store":                  0,
+		"max-age=nonsense":          defaultKeySetTTL,
+		"must-revalidate, no-cache": 0,
+	}
+	for header, expect := range tests {
+		t.Run(header, func(t *testing.T) {
+			assert.Equal(t, expect, cacheTTL(header))
+		})
+	}
+}
+
+func jwtSigningInput(t *testing.T, header map[string]string, claims map[string]any) string {
+	return base64.RawURLEncoding.EncodeToString(mustJSON(t, header)) + "." + base64.RawURLEncoding.EncodeToString(mustJSON(t, claims))
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return b
+}
@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// oidcFlowTTL is how long users have to sign in at the provider
+const oidcFlowTTL = 10 * time.Minute
+
+// OIDCProvider configures signing in with an OpenID Connect identity provider
+type OIDCProvider struct {
+	// Name identifies the provider in its urls (/auth/<name>/login) and in principal ids
+	Name string
+	// DisplayName is shown on the sign in button
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback registered with the provider, <base url>/auth/<name>/callback
+	RedirectURL string
+	// Scopes are requested on top of openid
+	Scopes []string
+	// RolesClaim is the claim listing the groups or roles of the user, e.g. groups. Roles maps its
+	// values to our roles, values without a mapping are ignored.
+	RolesClaim string
+	Roles      map[string]string
+}
+
+// LoginFunc is called once a user signed in with a provider. It should start a session for the
+// principal and respond, e.g. by redirecting home.
+type LoginFunc func(c echo.Context, p *Principal) error
+
+// OIDC signs users in with OpenID Connect providers using the authorization code flow with PKCE
+type OIDC struct {
+	providers []*oidcProvider
+	login     LoginFunc
+}
+
+type oidcProvider struct {
+	OIDCProvider
+	client *http.Client
+
+	// the discovery document and keys are loaded on first use so a provider being down doesn't
+	// keep the server from starting
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      *KeySet
+}
+
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// oidcFlow is what we need to remember between sending the user to the provider and the
+// callback. It is kept in a short lived cookie.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// NewOIDC creates the relying party for the providers. login starts a session once a user signed in.
+func NewOIDC(providers []OIDCProvider, client *http.Client, login LoginFunc) (o *OIDC, err error) {
+	o = &OIDC{login: login}
+	for _, p := range providers {
+		switch {
+		case p.Name == "":
+			return o, errors.New("oidc provider without a name")
+		case p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "":
+			return o, errors.Errorf("oidc provider needs an issuer, client id and redirect url | provider=[%s]", p.Name)
+		case o.provider(p.Name) != nil:
+			return o, errors.Errorf("duplicate oidc provider | provider=[%s]", p.Name)
+		}
+		if p.DisplayName == "" {
+			p.DisplayName = p.Name
+		}
+		o.providers = append(o.providers, &oidcProvider{OIDCProvider: p, client: client})
+	}
+	return o, nil
+}
+
+// Providers are the configured providers in order, e.g. for sign in buttons
+func (o *OIDC) Providers() []OIDCProvider {
+	providers := make([]OIDCProvider, 0, len(o.providers))
+	for _, p := range o.providers {
+		providers = append(providers, p.OIDCProvider)
+	}
+	return providers
+}
+
+// RegisterRoutes registers the login and callback routes of every provider
+func (o *OIDC) RegisterRoutes(g *echo.Group) {
+	g.GET("/auth/:provider/login", o.Login)
+	g.GET("/auth/:provider/callback", o.Callback)
+}
+
+// Login sends the user to the provider to sign in
+func (o *OIDC) Login(c echo.Context) error {
+	p := o.provider(c.Param("provider"))
+	if p == nil {
+		return echo.ErrNotFound.SetInternal(errors.Errorf("unknown oidc provider | provider=[%s]", c.Param("provider")))
+	}
+	d, err := p.load(c)
+	if err != nil {
+		return apperr.Wrap(err, apperr.CodeUnavailable, "Signing in is unavailable right now, try again later")
+	}
+
+	flow := oidcFlow{State: randomString(), Nonce: randomString(), Verifier: randomString()}
+	b, err := json.Marshal(flow)
+	if err != nil {
+		return errors.Wrap(err, "encoding oidc flow")
+	}
+	c.SetCookie(p.flowCookie(c, base64.RawURLEncoding.EncodeToString(b), int(oidcFlowTTL.Seconds())))
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.Scopes...), " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	return c.Redirect(http.StatusFound, appendQuery(d.AuthorizationEndpoint, q))
+}
+
+// Callback is where the provider sends the user back to. It checks the state, exchanges the code
+// for an id token, verifies the token and hands the principal to the login func.
+func (o *OIDC) Callback(c echo.Context) error {
+	p := o.provider(c.Param("provider"))
+	if p == nil {
+		return echo.ErrNotFound.SetInternal(errors.Errorf("unknown oidc provider | provider=[%s]", c.Param("provider")))
+	}
+
+	principal, err := p.callback(c)
+	if err != nil {
+		var ae *apperr.Error
+		if errors.As(err, &ae) {
+			return err
+		}
+		return apperr.Wrap(err, apperr.CodeUnauthenticated, "Signing in failed, try again")
+	}
+	return o.login(c, principal)
+}
+
+func (o *OIDC) provider(name string) *oidcProvider {
+	for _, p := range o.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *oidcProvider) callback(c echo.Context) (*Principal, error) {
+	cookie, err := c.Cookie(p.flowCookieName())
+	if err != nil {
+		return nil, errors.Errorf("no sign in in progress | provider=[%s]", p.Name)
+	}
+	// the flow can only be completed once
+	c.SetCookie(p.flowCookie(c, "", -1))
+
+	var flow oidcFlow
+	err = decodeSegment(cookie.Value, &flow)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding oidc flow | provider=[%s]", p.Name)
+	}
+	if subtle.ConstantTimeCompare([]byte(c.QueryParam("state")), []byte(flow.State)) != 1 {
+		return nil, errors.Errorf("state mismatch | provider=[%s]", p.Name)
+	}
+	if e := c.QueryParam("error"); e != "" {
+		return nil, errors.Errorf("provider returned an error | provider=[%s] error=[%s] description=[%s]", p.Name, e, c.QueryParam("error_description"))
+	}
+
+	d, err := p.load(c)
+	if err != nil {
+		return nil, apperr.Wrap(err, apperr.CodeUnavailable, "Signing in is unavailable right now, try again later")
+	}
+
+	idToken, err := p.exchange(c, d, c.QueryParam("code"), flow.Verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	algs := d.SigningAlgs
+	if len(algs) == 0 {
+		algs = []string{"RS256"}
+	}
+	claims, err := verifyJWT(c.Request().Context(), idToken, p.keys, algs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "verifying id token | provider=[%s]", p.Name)
+	}
+	err = claims.validate(d.Issuer, p.ClientID, time.Now())
+	if err != nil {
+		return nil, errors.Wrapf(err, "validating id token | provider=[%s]", p.Name)
+	}
+	if azp := claims.String("azp"); (len(claims.Audience) > 1 || azp != "") && azp != p.ClientID {
+		return nil, errors.Errorf("id token authorized for another client | provider=[%s] azp=[%s]", p.Name, azp)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(flow.Nonce)) != 1 {
+		return nil, errors.Errorf("nonce mismatch | provider=[%s]", p.Name)
+	}
+
+	return p.principal(claims), nil
+}
+
+// exchange trades the authorization code for the id token at the token endpoint
+func (p *oidcProvider) exchange(c echo.Context, d *oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrapf(err, "creating token request | provider=[%s]", p.Name)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	if p.ClientSecret != "" {
+		// client_secret_basic form encodes the credentials before base64 encoding them
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "exchanging code | provider=[%s]", p.Name)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", errors.Wrapf(err, "decoding token response | provider=[%s] status=[%d]", p.Name, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("exchanging code | provider=[%s] status=[%d] error=[%s] description=[%s]", p.Name, resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.Errorf("token response has no id token | provider=[%s]", p.Name)
+	}
+	return body.IDToken, nil
+}
+
+// principal maps the claims of the id token to a principal. The id is scoped to the provider
+// since subjects are only unique per issuer.
+func (p *oidcProvider) principal(claims Claims) *Principal {
+	principal := &Principal{
+		ID:        p.Name + ":" + claims.Subject,
+		Name:      displayName(claims),
+		AllScopes: true,
+		Method:    MethodOIDC,
+	}
+	if p.RolesClaim != "" {
+		for _, value := range claims.Strings(p.RolesClaim) {
+			role, ok := p.Roles[value]
+			if ok && !slices.Contains(principal.Roles, role) {
+				principal.Roles = append(principal.Roles, role)
+			}
+		}
+	}
+	return principal
+}
+
+// load fetches the discovery document of the provider once
+func (p *oidcProvider) load(c echo.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating discovery request | provider=[%s]", p.Name)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching discovery document | provider=[%s]", p.Name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("fetching discovery document | provider=[%s] status=[%d]", p.Name, resp.StatusCode)
+	}
+
+	var d oidcDiscovery
+	err = json.NewDecoder(resp.Body).Decode(&d)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding discovery document | provider=[%s]", p.Name)
+	}
+	// the issuer has to match exactly, otherwise one provider could impersonate another
+	if d.Issuer != p.Issuer {
+		return nil, errors.Errorf("discovery document is for another issuer | provider=[%s] issuer=[%s]", p.Name, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.Errorf("discovery document is missing endpoints | provider=[%s]", p.Name)
+	}
+
+	p.discovery = &d
+	p.keys = NewKeySet(d.JWKSURI, p.client)
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) flowCookieName() string {
+	return "oidc_" + p.Name
+}
+
+// flowCookie is only sent to the callback. Lax cookies are sent along when the provider
+// redirects back to us.
+func (p *oidcProvider) flowCookie(c echo.Context, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     p.flowCookieName(),
+		Value:    value,
+		Path:     "/auth/" + p.Name + "/callback",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	// crypto/rand never fails on supported platforms
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func appendQuery(endpoint string, q url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + q.Encode()
+	}
+	return endpoint + "?" + q.Encode()
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/auth/oidctest"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDC(t *testing.T) {
+	type tc struct {
+		claims      map[string]any
+		tamper      func(claims map[string]any)
+		secret      string
+		verifier    string
+		state       string
+		expectErr   bool
+		expectName  string
+		expectRoles []string
+	}
+
+	tests := map[string]tc{
+		"signs in": {
+			claims:     map[string]any{"name": "Alice"},
+			expectName: "Alice",
+		},
+		"maps groups to roles": {
+			claims:      map[string]any{"preferred_username": "alice", "groups": []string{"engineering", "platform-admins"}},
+			expectName:  "alice",
+			expectRoles: []string{RoleAdmin},
+		},
+		"wrong client secret": {
+			secret:    "guess",
+			expectErr: true,
+		},
+		"wrong PKCE verifier": {
+			verifier:  "guess",
+			expectErr: true,
+		},
+		"wrong state": {
+			state:     "guess",
+			expectErr: true,
+		},
+		"wrong nonce": {
+			tamper:    func(claims map[string]any) { claims["nonce"] = "guess" },
+			expectErr: true,
+		},
+		"wrong audience": {
+			tamper:    func(claims map[string]any) { claims["aud"] = "other-client" },
+			expectErr: true,
+		},
+		"authorized for another client": {
+			tamper:    func(claims map[string]any) { claims["aud"] = []string{"client", "other-client"} },
+			expectErr: true,
+		},
+		"expired": {
+			tamper:    func(claims map[string]any) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			idp := oidctest.NewProvider("client", "secret")
+			defer idp.Close()
+			idp.Claims = tc.claims
+			idp.Tamper = tc.tamper
+
+			secret := "secret"
+			if tc.secret != "" {
+				secret = tc.secret
+			}
+			var got *Principal
+			o, err := NewOIDC([]OIDCProvider{{
+				Name:         "corp",
+				Issuer:       idp.Issuer(),
+				ClientID:     "client",
+				ClientSecret: secret,
+				RedirectURL:  "http://app.test/auth/corp/callback",
+				RolesClaim:   "groups",
+				Roles:        map[string]string{"platform-admins": RoleAdmin},
+			}}, idp.Client(), func(c echo.Context, p *Principal) error {
+				got = p
+				return c.Redirect(http.StatusSeeOther, "/")
+			})
+			require.NoError(t, err)
+
+			e := echo.New()
+			o.RegisterRoutes(e.Group(""))
+
+			// start signing in and follow the redirect to the provider
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/corp/login", nil))
+			require.Equal(t, http.StatusFound, rec.Code)
+			cookies := rec.Result().Cookies()
+			require.Len(t, cookies, 1)
+
+			authorize, err := url.Parse(rec.Header().Get(echo.HeaderLocation))
+			require.NoError(t, err)
+			if tc.verifier != "" {
+				// a stolen code can't be redeemed without the verifier
+				q := authorize.Query()
+				q.Set("code_challenge", "bm90IHRoZSBjaGFsbGVuZ2Ugb2YgdGhlIHZlcmlmaWVy")
+				authorize.RawQuery = q.Encode()
+			}
+			client := idp.Client()
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+			resp, err := client.Get(authorize.String())
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusFound, resp.StatusCode)
+
+			// come back to the callback with the code
+			callback, err := url.Parse(resp.Header.Get("Location"))
+			require.NoError(t, err)
+			if tc.state != "" {
+				q := callback.Query()
+				q.Set("state", tc.state)
+				callback.RawQuery = q.Encode()
+			}
+			req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+			req.AddCookie(cookies[0])
+			rec = httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("provider")
+			c.SetParamValues("corp")
+			err = o.Callback(c)
+
+			if tc.expectErr {
+				var ae *apperr.Error
+				require.True(t, errors.As(err, &ae), "expected an apperr, got %v", err)
+				assert.Equal(t, apperr.CodeUnauthenticated, ae.Code)
+				assert.Nil(t, got)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, got)
+			assert.Equal(t, "corp:user-1", got.ID)
+			assert.Equal(t, MethodOIDC, got.Method)
+			assert.Equal(t, tc.expectName, got.Name)
+			assert.Equal(t, tc.expectRoles, got.Roles)
+		})
+	}
+}
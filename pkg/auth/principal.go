@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"slices"
+)
+
+// Method is how a principal authenticated
+type Method string
+
+const (
+	MethodClientCert Method = "client-cert"
+	MethodSession    Method = "session"
+	MethodBearer     Method = "bearer"
+	MethodAPIKey     Method = "api-key"
+	MethodBasic      Method = "basic"
+	MethodOIDC       Method = "oidc"
+)
+
+// RoleAdmin can see the operator pages like the error inbox
+const RoleAdmin = "admin"
+
+// Principal is who is making a request
+type Principal struct {
+	// ID is stable and unique, e.g. a user id or the SPIFFE id of a service
+	ID string
+	// Name is for display
+	Name  string
+	Roles []string
+	// Scopes limit what principals authenticated with a delegated credential like an API key may
+	// do. Principals acting as themselves, e.g. users signed in with a session, have AllScopes
+	// instead. A principal with neither is in no scope.
+	Scopes    []string
+	AllScopes bool
+	Method    Method
+}
+
+// HasRole reports whether the principal has the role
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && slices.Contains(p.Roles, role)
+}
+
+// HasScope reports whether the principal may act within the scope
+func (p *Principal) HasScope(scope string) bool {
+	return p != nil && (p.AllScopes || slices.Contains(p.Scopes, scope))
+}
+
+const principalKey = contextKey("principal")
+
+// NewContext returns a context carrying the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// PrincipalFromContext returns the principal of the request if it is authenticated. Templ
+// components can call it with their ctx.
+func PrincipalFromContext(ctx context.Context) (p *Principal, ok bool) {
+	p, ok = ctx.Value(principalKey).(*Principal)
+	return p, ok
+}
+
+// IsAuthenticated reports whether the request has a principal, e.g. to show a sign out button
+func IsAuthenticated(ctx context.Context) bool {
+	_, ok := PrincipalFromContext(ctx)
+	return ok
+}
+
+// HasRole reports whether the principal of the request has the role
+func HasRole(ctx context.Context, role string) bool {
+	p, _ := PrincipalFromContext(ctx)
+	return p.HasRole(role)
+}
@@ -0,0 +1,200 @@
+package errtrack
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxGroups bounds how many distinct failures are kept. The group seen least recently is
+	// evicted first.
+	maxGroups = 500
+	// maxSamples is how many of the most recent events are kept per group
+	maxSamples = 10
+)
+
+var defaultStore = NewStore(maxGroups, maxSamples)
+
+// Default returns the store every server error is captured in
+func Default() *Store {
+	return defaultStore
+}
+
+// Event is a single captured failure with the request it happened in
+type Event struct {
+	Time     time.Time
+	Status   int
+	Panic    bool
+	Message  string
+	Messages []string
+	Caller   string
+	Func     string
+	Stack    string
+
+	Method    string
+	Route     string
+	Path      string
+	UserAgent string
+	RequestID string
+	TraceID   string
+	// User is who made the request, if we know
+	User string
+
+	fingerprint string
+}
+
+// NewEvent captures err and the request metadata of c
+func NewEvent(c echo.Context, err error, status int) Event {
+	d := log.Inspect(err, log.WithStack())
+	req := c.Request()
+	ctx := req.Context()
+
+	e := Event{
+		Time:        time.Now(),
+		Status:      status,
+		Panic:       errors.As(err, new(*PanicError)),
+		Message:     d.Message,
+		Messages:    d.Messages,
+		Caller:      d.Caller,
+		Func:        d.Func,
+		Stack:       d.Stack,
+		Method:      req.Method,
+		Route:       c.Path(),
+		Path:        req.URL.Path,
+		UserAgent:   req.UserAgent(),
+		RequestID:   log.RequestIDFromContext(ctx),
+		fingerprint: d.Fingerprint,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		e.TraceID = sc.TraceID().String()
+	}
+	if p, ok := auth.PrincipalFromContext(ctx); ok {
+		e.User = p.ID
+	}
+	return e
+}
+
+// Group is every occurrence of the same failure
+type Group struct {
+	Fingerprint string
+	// Message, Func and Caller are from the first occurrence
+	Message   string
+	Func      string
+	Caller    string
+	Route     string
+	Panic     bool
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Samples are the most recent events, newest first
+	Samples []Event
+}
+
+// Store groups events by the fingerprint of their error in memory. It is bounded so a flood of
+// distinct failures can't exhaust memory.
+type Store struct {
+	mu         sync.Mutex
+	groups     map[string]*Group
+	maxGroups  int
+	maxSamples int
+}
+
+// NewStore creates a store that keeps at most maxGroups groups with maxSamples events each
+func NewStore(maxGroups, maxSamples int) *Store {
+	return &Store{
+		groups:     map[string]*Group{},
+		maxGroups:  maxGroups,
+		maxSamples: maxSamples,
+	}
+}
+
+// Capture adds the event to its group
+func (s *Store) Capture(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.groups[e.fingerprint]
+	if !ok {
+		if len(s.groups) >= s.maxGroups {
+			s.evict()
+		}
+		g = &Group{
+			Fingerprint: e.fingerprint,
+			Message:     e.Message,
+			Func:        e.Func,
+			Caller:      e.Caller,
+			Route:       e.Route,
+			Panic:       e.Panic,
+			FirstSeen:   e.Time,
+		}
+		s.groups[e.fingerprint] = g
+	}
+
+	g.Count++
+	g.LastSeen = e.Time
+	g.Samples = append([]Event{e}, g.Samples...)
+	if len(g.Samples) > s.maxSamples {
+		g.Samples = g.Samples[:s.maxSamples]
+	}
+}
+
+// evict drops the group seen least recently
+func (s *Store) evict() {
+	var oldest *Group
+	for _, g := range s.groups {
+		if oldest == nil || g.LastSeen.Before(oldest.LastSeen) {
+			oldest = g
+		}
+	}
+	if oldest != nil {
+		delete(s.groups, oldest.Fingerprint)
+	}
+}
+
+// Groups returns a copy of every group, most recently seen first
+func (s *Store) Groups() []Group {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := make([]Group, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, g.copy())
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].LastSeen.After(groups[j].LastSeen)
+	})
+	return groups
+}
+
+// Group returns a copy of the group with the fingerprint
+func (s *Store) Group(fingerprint string) (Group, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.groups[fingerprint]
+	if !ok {
+		return Group{}, false
+	}
+	return g.copy(), true
+}
+
+// Resolve forgets the group. It comes back as a new group if the failure happens again.
+func (s *Store) Resolve(fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.groups, fingerprint)
+}
+
+func (g *Group) copy() Group {
+	c := *g
+	c.Samples = append([]Event(nil), g.Samples...)
+	return c
+}
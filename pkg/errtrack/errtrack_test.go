@@ -0,0 +1,128 @@
+package errtrack
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func failure() error {
+	return errors.New("db is down")
+}
+
+func otherFailure() error {
+	return errors.New("cache is down")
+}
+
+func explode() {
+	var m map[string]int
+	m["boom"]++
+}
+
+func TestStore(t *testing.T) {
+	type tc struct {
+		errs          []error
+		maxGroups     int
+		maxSamples    int
+		expectCounts  []int
+		expectSamples []int
+	}
+
+	tests := map[string]tc{
+		"groups the same failure": {
+			errs:          []error{failure(), errors.Wrap(failure(), "loading user"), otherFailure()},
+			maxGroups:     10,
+			maxSamples:    10,
+			expectCounts:  []int{1, 2},
+			expectSamples: []int{1, 2},
+		},
+		"bounds the samples": {
+			errs:          []error{failure(), failure(), failure()},
+			maxGroups:     10,
+			maxSamples:    2,
+			expectCounts:  []int{3},
+			expectSamples: []int{2},
+		},
+		"evicts the group seen least recently": {
+			errs:          []error{failure(), otherFailure()},
+			maxGroups:     1,
+			maxSamples:    10,
+			expectCounts:  []int{1},
+			expectSamples: []int{1},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := NewStore(tc.maxGroups, tc.maxSamples)
+			e := echo.New()
+			for _, err := range tc.errs {
+				c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+				s.Capture(NewEvent(c, err, http.StatusInternalServerError))
+				// keep the last seen times apart so the order is stable
+				time.Sleep(time.Millisecond)
+			}
+
+			groups := s.Groups()
+			require.Len(t, groups, len(tc.expectCounts))
+			for i, g := range groups {
+				assert.Equal(t, tc.expectCounts[i], g.Count)
+				assert.Len(t, g.Samples, tc.expectSamples[i])
+
+				found, ok := s.Group(g.Fingerprint)
+				require.True(t, ok)
+				assert.Equal(t, g, found)
+			}
+			// the newest group is first
+			assert.Equal(t, tc.errs[len(tc.errs)-1].Error(), groups[0].Samples[0].Message)
+
+			s.Resolve(groups[0].Fingerprint)
+			_, ok := s.Group(groups[0].Fingerprint)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestPanic(t *testing.T) {
+	s := NewStore(10, 10)
+
+	e := echo.New()
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
+		DisablePrintStack: true,
+		LogErrorFunc: func(c echo.Context, err error, stack []byte) error {
+			return Panic(err)
+		},
+	}))
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		s.Capture(NewEvent(c, err, http.StatusInternalServerError))
+		_ = c.NoContent(http.StatusInternalServerError)
+	}
+	e.GET("/users/:id", func(c echo.Context) error {
+		explode()
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{ID: "bob"}))
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	groups := s.Groups()
+	require.Len(t, groups, 1)
+	event := groups[0].Samples[0]
+	assert.True(t, event.Panic)
+	assert.Contains(t, event.Message, "panic: assignment to entry in nil map")
+	// the stack starts where the panic happened, not in the recover middleware
+	assert.Equal(t, "explode", event.Func)
+	assert.Equal(t, "/users/:id", event.Route)
+	assert.Equal(t, "/users/1", event.Path)
+	assert.Equal(t, "bob", event.User)
+}
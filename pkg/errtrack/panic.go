@@ -0,0 +1,64 @@
+package errtrack
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PanicError is a panic recovered from a handler. Its stack starts where the panic happened.
+type PanicError struct {
+	err   error
+	stack []uintptr
+}
+
+// Panic wraps a recovered panic. It must be called from the deferred function that recovered it,
+// e.g. in handler.Recover, so the panicking frames are still on the stack.
+func Panic(err error) error {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	pcs = pcs[:n]
+
+	// drop the recovery frames and the runtime's panic machinery (e.g. sigpanic for a nil
+	// dereference) so the stack starts at the panic
+	for i, pc := range pcs {
+		if funcName(pc) != "runtime.gopanic" {
+			continue
+		}
+		i++
+		for i < len(pcs) && strings.HasPrefix(funcName(pcs[i]), "runtime.") {
+			i++
+		}
+		pcs = pcs[i:]
+		break
+	}
+
+	return &PanicError{err: err, stack: pcs}
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("panic: %s", p.err)
+}
+
+func (p *PanicError) Unwrap() error {
+	return p.err
+}
+
+// StackTrace implements the pkg/errors stack tracer so log.Callers can read it
+func (p *PanicError) StackTrace() errors.StackTrace {
+	st := make(errors.StackTrace, len(p.stack))
+	for i, pc := range p.stack {
+		st[i] = errors.Frame(pc)
+	}
+	return st
+}
+
+func funcName(pc uintptr) string {
+	f := runtime.FuncForPC(pc - 1)
+	if f == nil {
+		return ""
+	}
+	return f.Name()
+}
@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/accounts"
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+	pages "github.com/grindlemire/gothem-stack/web/pages/accounts"
+
+	"github.com/a-h/templ"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// AccountsHandler serves the sign up, sign in and password reset flows of local accounts
+type AccountsHandler struct {
+	accounts   *accounts.Service
+	sessionTTL time.Duration
+	// providers get a sign in button on the sign in page
+	providers []pages.Provider
+}
+
+func NewAccountsHandler(service *accounts.Service, sessionTTL time.Duration, providers []auth.OIDCProvider) (h *AccountsHandler, err error) {
+	h = &AccountsHandler{
+		accounts:   service,
+		sessionTTL: sessionTTL,
+	}
+	for _, p := range providers {
+		h.providers = append(h.providers, pages.Provider{
+			Label: p.DisplayName,
+			URL:   "/auth/" + p.Name + "/login",
+		})
+	}
+	return h, nil
+}
+
+// RegisterRoutes registers all the subroutes for the accounts handler to manage. The group
+// should identify the principal with an auth.Optional policy, anonymousOnly is added to the
+// pages that make no sense once signed in (auth.AnonymousOnly).
+func (h *AccountsHandler) RegisterRoutes(g *echo.Group, anonymousOnly echo.MiddlewareFunc) {
+	g.GET("/signup", h.RenderSignup, anonymousOnly)
+	g.POST("/signup", h.Signup, anonymousOnly)
+	g.GET("/login", h.RenderLogin, anonymousOnly)
+	g.POST("/login", h.Login, anonymousOnly)
+	g.GET("/forgot-password", h.RenderForgotPassword, anonymousOnly)
+	g.POST("/forgot-password", h.ForgotPassword, anonymousOnly)
+	g.GET("/reset-password", h.RenderResetPassword, anonymousOnly)
+	g.POST("/reset-password", h.ResetPassword, anonymousOnly)
+
+	g.GET("/verify", h.RenderVerify)
+	g.POST("/verify", h.Verify)
+	g.POST("/logout", h.Logout)
+}
+
+func (h *AccountsHandler) RenderSignup(c echo.Context) error {
+	return render(c, pages.Signup(pages.NewForm(nil, nil)))
+}
+
+func (h *AccountsHandler) Signup(c echo.Context) error {
+	values, err := c.FormParams()
+	if err != nil {
+		return apperr.Wrap(err, apperr.CodeInvalidArgument, "Invalid form")
+	}
+
+	err = h.accounts.Signup(c.Request().Context(), values.Get("name"), values.Get("email"), values.Get("password"))
+	if err != nil {
+		return formFailed(c, err, values, pages.SignupForm, pages.Signup)
+	}
+	return formDone(c, "Check your email", "We sent you a link to verify your email.")
+}
+
+func (h *AccountsHandler) RenderLogin(c echo.Context) error {
+	return render(c, pages.Login(pages.NewForm(nil, nil), h.providers))
+}
+
+func (h *AccountsHandler) Login(c echo.Context) error {
+	values, err := c.FormParams()
+	if err != nil {
+		return apperr.Wrap(err, apperr.CodeInvalidArgument, "Invalid form")
+	}
+
+	ctx := c.Request().Context()
+	token, u, err := h.accounts.Login(ctx, values.Get("email"), values.Get("password"))
+	if err != nil {
+		return formFailed(c, err, values, pages.LoginForm, func(f pages.Form) templ.Component {
+			return pages.Login(f, h.providers)
+		})
+	}
+
+	log.FromContext(ctx).Info("user signed in", zap.String("user_id", u.ID))
+	c.SetCookie(h.sessionCookie(c, token, int(h.sessionTTL.Seconds())))
+	return redirect(c, "/")
+}
+
+// SignIn starts a session for a user who signed in with an identity provider. It is the
+// auth.LoginFunc of the OIDC providers.
+func (h *AccountsHandler) SignIn(c echo.Context, p *auth.Principal) error {
+	token, u, err := h.accounts.ExternalLogin(c.Request().Context(), p)
+	if err != nil {
+		return err
+	}
+
+	log.FromContext(c.Request().Context()).Info("user signed in", zap.String("user_id", u.ID), zap.String("auth_method", string(p.Method)))
+	c.SetCookie(h.sessionCookie(c, token, int(h.sessionTTL.Seconds())))
+	return redirect(c, "/")
+}
+
+func (h *AccountsHandler) Logout(c echo.Context) error {
+	cookie, err := c.Cookie(accounts.SessionCookie)
+	if err == nil {
+		err = h.accounts.Logout(c.Request().Context(), cookie.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.SetCookie(h.sessionCookie(c, "", -1))
+	return redirect(c, "/")
+}
+
+// RenderVerify asks to confirm the verification instead of verifying right away, since mail
+// scanners following the link would use up the token before the user gets to it
+func (h *AccountsHandler) RenderVerify(c echo.Context) error {
+	token := c.QueryParam("token")
+	err := h.accounts.CheckVerifyToken(c.Request().Context(), token)
+	if err != nil {
+		return invalidLink(c, err)
+	}
+	return render(c, pages.Verify(token))
+}
+
+func (h *AccountsHandler) Verify(c echo.Context) error {
+	u, err := h.accounts.Verify(c.Request().Context(), c.FormValue("token"))
+	if err != nil {
+		return invalidLink(c, err)
+	}
+	return render(c, pages.Verified(u.Name))
+}
+
+func (h *AccountsHandler) RenderForgotPassword(c echo.Context) error {
+	return render(c, pages.ForgotPassword(pages.NewForm(nil, nil)))
+}
+
+func (h *AccountsHandler) ForgotPassword(c echo.Context) error {
+	values, err := c.FormParams()
+	if err != nil {
+		return apperr.Wrap(err, apperr.CodeInvalidArgument, "Invalid form")
+	}
+
+	err = h.accounts.ForgotPassword(c.Request().Context(), values.Get("email"))
+	if err != nil {
+		return formFailed(c, err, values, pages.ForgotPasswordForm, pages.ForgotPassword)
+	}
+	return formDone(c, "Check your email", "If there is an account for that email we sent it a link to reset the password.")
+}
+
+func (h *AccountsHandler) RenderResetPassword(c echo.Context) error {
+	token := c.QueryParam("token")
+	err := h.accounts.CheckResetToken(c.Request().Context(), token)
+	if err != nil {
+		return invalidLink(c, err)
+	}
+	return render(c, pages.ResetPassword(token, pages.NewForm(nil, nil)))
+}
+
+func (h *AccountsHandler) ResetPassword(c echo.Context) error {
+	values, err := c.FormParams()
+	if err != nil {
+		return apperr.Wrap(err, apperr.CodeInvalidArgument, "Invalid form")
+	}
+
+	token := values.Get("token")
+	err = h.accounts.ResetPassword(c.Request().Context(), token, values.Get("password"))
+	if err != nil {
+		return formFailed(c, err, values,
+			func(f pages.Form) templ.Component { return pages.ResetPasswordForm(token, f) },
+			func(f pages.Form) templ.Component { return pages.ResetPassword(token, f) },
+		)
+	}
+	return formDone(c, "Password changed", "Your password was changed. Sign in with your new password.")
+}
+
+// sessionCookie can't be read by scripts and isn't sent along with cross site posts, which keeps
+// other sites from submitting forms as the user
+func (h *AccountsHandler) sessionCookie(c echo.Context, token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     accounts.SessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// formFailed renders the form again with what was wrong with it. htmx swaps the form in place so
+// the errors show up inline, plain form posts get the whole page. Anything but a client error
+// goes to the error handler.
+func formFailed(c echo.Context, err error, values url.Values, fragment, page func(pages.Form) templ.Component) error {
+	var ae *apperr.Error
+	if !errors.As(err, &ae) || ae.Status >= http.StatusInternalServerError {
+		return err
+	}
+
+	log.FromContext(c.Request().Context()).Debug("form rejected", zap.String("code", string(ae.Code)), zap.String("reason", ae.Error()))
+	f := pages.NewForm(values, ae)
+	if isHTMX(c) {
+		return render(c, fragment(f), withStatus(ae.Status))
+	}
+	return render(c, page(f), withStatus(ae.Status))
+}
+
+// formDone replaces a form that went through with a notice
+func formDone(c echo.Context, title, message string) error {
+	if isHTMX(c) {
+		return render(c, pages.Notice(message))
+	}
+	return render(c, pages.NoticePage(title, message))
+}
+
+// invalidLink renders the page for verification and reset links that can't be used
+func invalidLink(c echo.Context, err error) error {
+	var ae *apperr.Error
+	if !errors.As(err, &ae) || ae.Status >= http.StatusInternalServerError {
+		return err
+	}
+	return render(c, pages.InvalidLink(ae.Message), withStatus(ae.Status))
+}
+
+// redirect navigates htmx requests with HX-Redirect, a plain redirect would be followed by the
+// ajax request and swapped into the target
+func redirect(c echo.Context, to string) error {
+	if isHTMX(c) {
+		c.Response().Header().Set("HX-Redirect", to)
+		return c.NoContent(http.StatusOK)
+	}
+	return c.Redirect(http.StatusSeeOther, to)
+}
+
+func isHTMX(c echo.Context) bool {
+	return c.Request().Header.Get("HX-Request") == "true"
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/accounts"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lastEmail keeps the body of the last account email
+type lastEmail struct {
+	body string
+}
+
+func (l *lastEmail) Send(ctx context.Context, m accounts.Message) error {
+	l.body = m.Body
+	return nil
+}
+
+func TestAccountForms(t *testing.T) {
+	mail := &lastEmail{}
+	service, err := accounts.NewService(accounts.NewMemoryStore(), mail, accounts.Config{
+		BaseURL:         "https://example.com",
+		SessionTTL:      time.Hour,
+		MaxFailedLogins: 5,
+		LockoutDuration: time.Minute,
+		PasswordParams:  accounts.PasswordParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+	})
+	require.NoError(t, err)
+	h, err := NewAccountsHandler(service, time.Hour, nil)
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.HTTPErrorHandler = Error
+	authn := auth.NewChain(auth.SessionCookie(accounts.SessionCookie, service.Authenticate))
+	h.RegisterRoutes(e.Group("", authn.Middleware(auth.Optional)), authn.Middleware(auth.AnonymousOnly))
+
+	type tc struct {
+		path           string
+		form           url.Values
+		htmx           bool
+		signedIn       bool
+		expectStatus   int
+		expectBody     []string
+		expectRedirect string
+		expectCookie   bool
+	}
+
+	tests := map[string]tc{
+		"htmx gets the form with inline errors": {
+			path:         "/signup",
+			form:         url.Values{"name": {"Alice"}, "email": {"not an email"}, "password": {"short"}},
+			htmx:         true,
+			expectStatus: http.StatusBadRequest,
+			expectBody:   []string{`<form`, `value="Alice"`, "Enter a valid email address", "Use at least 10 characters"},
+		},
+		"plain form posts get the whole page": {
+			path:         "/signup",
+			form:         url.Values{"email": {"alice@example.com"}},
+			expectStatus: http.StatusBadRequest,
+			expectBody:   []string{"<!doctype html>", "Enter your name"},
+		},
+		"signing up sends the verification email": {
+			path:         "/signup",
+			form:         url.Values{"name": {"Alice"}, "email": {"alice@example.com"}, "password": {"a long enough password"}},
+			htmx:         true,
+			expectStatus: http.StatusOK,
+			expectBody:   []string{"We sent you a link to verify your email."},
+		},
+		"wrong password is shown on the form": {
+			path:         "/login",
+			form:         url.Values{"email": {"bob@example.com"}, "password": {"a long enough password"}},
+			htmx:         true,
+			expectStatus: http.StatusUnauthorized,
+			expectBody:   []string{"Wrong email or password", `value="bob@example.com"`},
+		},
+		"signed in users can't sign up again": {
+			path:           "/signup",
+			form:           url.Values{},
+			signedIn:       true,
+			expectStatus:   http.StatusSeeOther,
+			expectRedirect: "/",
+		},
+		"signing in with htmx redirects with the session cookie": {
+			path:           "/login",
+			form:           url.Values{"email": {"carol@example.com"}, "password": {"a long enough password"}},
+			htmx:           true,
+			expectStatus:   http.StatusOK,
+			expectRedirect: "/",
+			expectCookie:   true,
+		},
+	}
+
+	// carol verifies her account by following the link in the email and confirming. Opening the
+	// link, e.g. by a mail scanner, doesn't use it up.
+	ctx := context.Background()
+	require.NoError(t, service.Signup(ctx, "Carol", "carol@example.com", "a long enough password"))
+	_, link, ok := strings.Cut(mail.body, "https://example.com")
+	require.True(t, ok)
+	for range 2 {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, link, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "Verify email")
+	}
+	verifyURL, err := url.Parse(link)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(verifyURL.RawQuery))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "your email is verified")
+	session, _, err := service.Login(ctx, "carol@example.com", "a long enough password")
+	require.NoError(t, err)
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			req.Header.Set(echo.HeaderAccept, "text/html")
+			if tc.htmx {
+				req.Header.Set("HX-Request", "true")
+			}
+			if tc.signedIn {
+				req.AddCookie(&http.Cookie{Name: accounts.SessionCookie, Value: session})
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			for _, s := range tc.expectBody {
+				assert.Contains(t, rec.Body.String(), s)
+			}
+			assert.NotContains(t, rec.Body.String(), "a long enough password")
+			switch {
+			case tc.htmx && tc.expectRedirect != "":
+				assert.Equal(t, tc.expectRedirect, rec.Header().Get("HX-Redirect"))
+			case tc.expectRedirect != "":
+				assert.Equal(t, tc.expectRedirect, rec.Header().Get(echo.HeaderLocation))
+			}
+			assert.Equal(t, tc.expectCookie, strings.Contains(rec.Header().Get(echo.HeaderSetCookie), accounts.SessionCookie+"="))
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/labstack/echo/v4"
+)
+
+// APIHandler serves the json api for mobile and command line clients
+type APIHandler struct{}
+
+func NewAPIHandler() (h *APIHandler, err error) {
+	return &APIHandler{}, nil
+}
+
+// RegisterRoutes registers the api routes. The group should require a principal.
+func (h *APIHandler) RegisterRoutes(g *echo.Group) {
+	g.GET("/me", h.Me)
+}
+
+type meResponse struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name,omitempty"`
+	Roles  []string `json:"roles"`
+	Method string   `json:"method"`
+}
+
+// Me tells clients who they are authenticated as
+func (h *APIHandler) Me(c echo.Context) error {
+	p, _ := auth.PrincipalFromContext(c.Request().Context())
+	roles := p.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return c.JSON(http.StatusOK, meResponse{
+		ID:     p.ID,
+		Name:   p.Name,
+		Roles:  roles,
+		Method: string(p.Method),
+	})
+}
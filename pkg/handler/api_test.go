@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPI(t *testing.T) {
+	type tc struct {
+		token           string
+		expectStatus    int
+		expectBody      string
+		expectChallenge string
+	}
+
+	tests := map[string]tc{
+		"authenticated": {
+			token:        "good-token",
+			expectStatus: http.StatusOK,
+			expectBody:   `{"id":"cli-1","name":"CLI","roles":["admin"],"method":"bearer"}`,
+		},
+		"no token": {
+			expectStatus:    http.StatusUnauthorized,
+			expectBody:      `{"message":"Sign in to continue","code":"unauthenticated"}`,
+			expectChallenge: "Bearer",
+		},
+		"invalid token": {
+			token:           "bad-token",
+			expectStatus:    http.StatusUnauthorized,
+			expectBody:      `{"message":"Invalid credentials","code":"unauthenticated"}`,
+			expectChallenge: `Bearer error="invalid_token"`,
+		},
+	}
+
+	chain := auth.NewChain(auth.Bearer(func(ctx context.Context, token string) (*auth.Principal, error) {
+		if token != "good-token" {
+			return nil, errors.New("token expired")
+		}
+		return &auth.Principal{ID: "cli-1", Name: "CLI", Roles: []string{auth.RoleAdmin}, AllScopes: true, Method: auth.MethodBearer}, nil
+	}))
+	h, err := NewAPIHandler()
+	require.NoError(t, err)
+	e := echo.New()
+	e.HTTPErrorHandler = Error
+	h.RegisterRoutes(e.Group("/api", chain.Middleware(auth.Required)))
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+			req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+			if tc.token != "" {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			assert.JSONEq(t, tc.expectBody, rec.Body.String())
+			assert.Equal(t, tc.expectChallenge, rec.Header().Get(echo.HeaderWWWAuthenticate))
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apikeys"
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+	"github.com/grindlemire/gothem-stack/web/pages/accounts"
+	pages "github.com/grindlemire/gothem-stack/web/pages/apikeys"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// APIKeysHandler serves the page where users create and revoke their API keys
+type APIKeysHandler struct {
+	keys *apikeys.Service
+}
+
+func NewAPIKeysHandler(service *apikeys.Service) (h *APIKeysHandler, err error) {
+	return &APIKeysHandler{
+		keys: service,
+	}, nil
+}
+
+// RegisterRoutes registers all the subroutes for the API keys handler to manage. The group
+// should require a signed in user, keys are created for the principal of the request.
+func (h *APIKeysHandler) RegisterRoutes(g *echo.Group) {
+	g.GET("", h.RenderKeys)
+	g.POST("", h.CreateKey)
+	g.POST("/:id/revoke", h.RevokeKey)
+}
+
+func (h *APIKeysHandler) RenderKeys(c echo.Context) error {
+	v, err := h.view(c, accounts.NewForm(nil, nil), "")
+	if err != nil {
+		return err
+	}
+	return render(c, pages.Page(v))
+}
+
+func (h *APIKeysHandler) CreateKey(c echo.Context) error {
+	values, err := c.FormParams()
+	if err != nil {
+		return apperr.Wrap(err, apperr.CodeInvalidArgument, "Invalid form")
+	}
+
+	// anything but one of the offered number of days is rejected by the service as a negative ttl
+	ttl := time.Duration(-1)
+	if days, err := strconv.Atoi(values.Get("expires")); err == nil && days >= 0 {
+		ttl = time.Duration(days) * 24 * time.Hour
+	}
+
+	p, _ := auth.PrincipalFromContext(c.Request().Context())
+	key, _, err := h.keys.Create(c.Request().Context(), p, values.Get("name"), values["scopes"], ttl)
+	if err != nil {
+		var ae *apperr.Error
+		if !errors.As(err, &ae) || ae.Status >= http.StatusInternalServerError {
+			return err
+		}
+		return h.renderKeys(c, accounts.NewForm(values, ae), "", withStatus(ae.Status))
+	}
+	// the key is rendered instead of redirecting since this response is the only time it is shown
+	return h.renderKeys(c, accounts.NewForm(nil, nil), key, withHeader("Cache-Control", "no-store"))
+}
+
+func (h *APIKeysHandler) RevokeKey(c echo.Context) error {
+	p, _ := auth.PrincipalFromContext(c.Request().Context())
+	_, err := h.keys.Revoke(c.Request().Context(), p, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if !isHTMX(c) {
+		return c.Redirect(http.StatusSeeOther, "/settings/api-keys")
+	}
+	return h.renderKeys(c, accounts.NewForm(nil, nil), "")
+}
+
+// renderKeys renders the keys for htmx to swap in place, or the whole page for plain form posts
+func (h *APIKeysHandler) renderKeys(c echo.Context, f accounts.Form, created string, opts ...renderOption) error {
+	v, err := h.view(c, f, created)
+	if err != nil {
+		return err
+	}
+	if isHTMX(c) {
+		return render(c, pages.Keys(v), opts...)
+	}
+	return render(c, pages.Page(v), opts...)
+}
+
+func (h *APIKeysHandler) view(c echo.Context, f accounts.Form, created string) (pages.View, error) {
+	p, _ := auth.PrincipalFromContext(c.Request().Context())
+	keys, err := h.keys.Keys(c.Request().Context(), p)
+	if err != nil {
+		return pages.View{}, err
+	}
+	return pages.View{
+		Keys:    keys,
+		Scopes:  h.keys.Scopes(),
+		Form:    f,
+		Created: created,
+		Now:     time.Now(),
+	}, nil
+}
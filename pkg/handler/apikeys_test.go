@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/grindlemire/gothem-stack/pkg/apikeys"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var apiKeyRE = regexp.MustCompile(apikeys.Prefix + `[A-Za-z0-9_-]{43}`)
+
+func TestAPIKeysPage(t *testing.T) {
+	service, err := apikeys.NewService(apikeys.NewMemoryStore(), []apikeys.Scope{
+		{Name: "orders:read", Description: "Read orders"},
+	})
+	require.NoError(t, err)
+	h, err := NewAPIKeysHandler(service)
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.HTTPErrorHandler = Error
+	authn := auth.NewChain(auth.SessionCookie("session", func(ctx context.Context, session string) (*auth.Principal, error) {
+		return &auth.Principal{ID: session, AllScopes: true, Method: auth.MethodSession}, nil
+	}))
+	h.RegisterRoutes(e.Group("/settings/api-keys", authn.Middleware(auth.Required)))
+
+	do := func(method, path, user string, form url.Values, htmx bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		req.Header.Set(echo.HeaderAccept, echo.MIMETextHTML)
+		if htmx {
+			req.Header.Set("HX-Request", "true")
+		}
+		if user != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: user})
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// signing in is required
+	rec := do(http.MethodGet, "/settings/api-keys", "", nil, false)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// invalid forms are swapped in place with their errors
+	rec = do(http.MethodPost, "/settings/api-keys", "alice", url.Values{"name": {"Acme"}, "expires": {"30"}}, true)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `value="Acme"`)
+	assert.Contains(t, rec.Body.String(), "Pick at least one scope")
+	assert.NotContains(t, rec.Body.String(), "<!doctype html>")
+
+	// the key is shown once when it is created
+	rec = do(http.MethodPost, "/settings/api-keys", "alice", url.Values{"name": {"Acme"}, "scopes": {"orders:read"}, "expires": {"30"}}, true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	key := apiKeyRE.FindString(rec.Body.String())
+	require.NotEmpty(t, key)
+	p, err := service.Authenticate(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"orders:read"}, p.Scopes)
+
+	rec = do(http.MethodGet, "/settings/api-keys", "alice", nil, false)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Acme")
+	assert.NotContains(t, rec.Body.String(), key)
+	revoke := regexp.MustCompile(`/settings/api-keys/[0-9a-f-]{36}/revoke`).FindString(rec.Body.String())
+	require.NotEmpty(t, revoke)
+
+	// other users neither see nor revoke the key
+	rec = do(http.MethodGet, "/settings/api-keys", "bob", nil, false)
+	assert.NotContains(t, rec.Body.String(), "Acme")
+	rec = do(http.MethodPost, revoke, "bob", nil, false)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// revoking without htmx goes back to the page
+	rec = do(http.MethodPost, revoke, "alice", nil, false)
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/settings/api-keys", rec.Header().Get(echo.HeaderLocation))
+	_, err = service.Authenticate(context.Background(), key)
+	assert.Error(t, err)
+	rec = do(http.MethodGet, "/settings/api-keys", "alice", nil, false)
+	assert.Contains(t, rec.Body.String(), "revoked")
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/grindlemire/gothem-stack/pkg/log"
+	"github.com/grindlemire/gothem-stack/web/pages/errorpage"
+
+	"github.com/labstack/echo/v4"
+)
+
+// snippetLines is how many lines of source are shown around each frame
+const snippetLines = 5
+
+// devErrorPages shows the developer error page for server errors instead of the regular page
+var devErrorPages bool
+
+// devPageRedact are the parameters and headers whose values the developer error page never shows
+// and the patterns scrubbed from every other value
+var devPageRedact = log.DefaultRedactConfig()
+
+// EnableDevErrorPages shows browsers the stack, source, request and route of server errors. It
+// exposes the internals of the app so only enable it outside of prod.
+func EnableDevErrorPages(enabled bool) {
+	devErrorPages = enabled
+}
+
+// newDevError collects what the developer error page shows about err
+func newDevError(c echo.Context, err error, code int) errorpage.DevError {
+	d := log.Inspect(err, log.WithStack())
+	req := c.Request()
+
+	e := errorpage.DevError{
+		Status:  code,
+		Message: d.Message,
+		Method:  req.Method,
+		URL:     redactURL(req.URL),
+		Route:   c.Path(),
+		Chain:   d.Messages,
+	}
+
+	for _, f := range d.Frames {
+		e.Frames = append(e.Frames, errorpage.DevFrame{
+			Func:    f.Func,
+			File:    f.File,
+			Line:    f.Line,
+			Library: isLibrary(f),
+			Source:  sourceSnippet(f.File, f.Line),
+		})
+	}
+
+	for i, name := range c.ParamNames() {
+		e.Params = append(e.Params, errorpage.KeyValue{Key: "path " + name, Value: redactValue(name, c.ParamValues()[i])})
+	}
+	e.Params = append(e.Params, keyValues("query ", req.URL.Query())...)
+	// only show the form if the handler parsed it, we can't read the body a second time
+	e.Params = append(e.Params, keyValues("form ", req.PostForm)...)
+	e.Headers = keyValues("", req.Header)
+
+	return e
+}
+
+// redactURL returns the url with the values of sensitive query parameters, e.g. reset tokens, replaced
+// and the rest scrubbed
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	changed := false
+	for k, vs := range query {
+		for i, v := range vs {
+			if redacted := redactValue(k, v); redacted != v {
+				vs[i] = redacted
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return u.String()
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// redactValue hides the value of a sensitive parameter or header and scrubs the patterns from any other
+func redactValue(key string, value string) string {
+	if sensitive(key) {
+		return log.Redacted
+	}
+	return devPageRedact.Scrub(value)
+}
+
+// sensitive reports whether the value of the parameter or header is a credential the page never
+// shows, no matter who is looking at it. Names containing a key count too, e.g. new_password.
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	contains := func(k string) bool { return strings.Contains(key, strings.ToLower(k)) }
+	return slices.ContainsFunc(devPageRedact.Keys, contains) || slices.ContainsFunc(devPageRedact.Headers, contains)
+}
+
+// isLibrary reports whether the frame is in the standard library or a dependency rather than our code
+func isLibrary(f log.Frame) bool {
+	if strings.Contains(f.File, "/pkg/mod/") || strings.Contains(f.File, "/vendor/") {
+		return true
+	}
+	// standard library import paths don't have a domain
+	first, _, _ := strings.Cut(f.Func, "/")
+	return !strings.Contains(first, ".")
+}
+
+// sourceSnippet reads the lines around line from file. It returns nothing if the source isn't
+// available, e.g. when the binary was built somewhere else.
+func sourceSnippet(file string, line int) []errorpage.SourceLine {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var snippet []errorpage.SourceLine
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan() && n <= line+snippetLines; n++ {
+		if n < line-snippetLines {
+			continue
+		}
+		snippet = append(snippet, errorpage.SourceLine{
+			Number:  n,
+			Text:    scanner.Text(),
+			Current: n == line,
+		})
+	}
+	return snippet
+}
+
+// keyValues flattens headers or parameters sorted by key, with the sensitive values redacted
+func keyValues(prefix string, values map[string][]string) []errorpage.KeyValue {
+	var kvs []errorpage.KeyValue
+	for k, vs := range values {
+		kvs = append(kvs, errorpage.KeyValue{Key: prefix + k, Value: redactValue(k, strings.Join(vs, ", "))})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs
+}
@@ -1,63 +1,177 @@
 package handler
 
 import (
-	"encoding/json"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/errtrack"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+	"github.com/grindlemire/gothem-stack/web/pages/errorpage"
+
+	"github.com/a-h/templ"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// Error is the echo error handler. It logs err and renders it for whoever is asking: a page for
+// browsers, a toast for htmx and json for everyone else. Return an *apperr.Error from handlers to
+// control the code, status, message and log level, other errors become opaque 500s.
 func Error(err error, c echo.Context) {
 	if c.Response().Committed {
 		return
 	}
 
-	he, ok := err.(*echo.HTTPError)
-	if ok {
-		// If there is an internal error then use that for printing
-		if he.Internal != nil {
-			err = he.Internal
-		}
-	} else {
-		he = &echo.HTTPError{
-			Code:     http.StatusInternalServerError,
-			Message:  http.StatusText(http.StatusInternalServerError),
-			Internal: err,
-		}
-	}
-
-	code := he.Code
-	message := he.Message
+	ae := toAppError(err)
+	code := ae.Status
 
-	// only log unauthorized errors at the debug level
-	if !errors.Is(he, echo.ErrUnauthorized) {
-		zap.S().Error(err)
-	} else {
-		zap.S().Debug(err)
+	// log with the request logger so the line carries the request id, route and trace. Server
+	// errors carry their stack so they can be grouped by error reporting tools and are captured
+	// in the error inbox
+	logger := log.FromContext(c.Request().Context())
+	if ce := logger.Check(ae.Level, ae.Error()); ce != nil {
+		fields := []zap.Field{zap.String("code", string(ae.Code))}
+		if code >= http.StatusInternalServerError {
+			fields = append(fields, log.Callers(ae, log.WithStack())...)
+		} else {
+			fields = append(fields, log.Callers(ae)...)
+		}
+		ce.Write(fields...)
 	}
-
-	switch m := he.Message.(type) {
-	case string:
-		message = echo.Map{"message": m}
-	case json.Marshaler:
-		// do nothing - this type knows how to format itself to JSON
-	case error:
-		message = echo.Map{"message": m.Error()}
+	if code >= http.StatusInternalServerError {
+		errtrack.Default().Capture(errtrack.NewEvent(c, ae, code))
 	}
 
 	// Send response
 	if c.Request().Method == http.MethodHead {
-		err = c.NoContent(he.Code)
+		err = c.NoContent(code)
 		if err != nil {
-			zap.S().Error(errors.Wrap(err, "sending no content"))
+			logger.Sugar().Error(errors.Wrap(err, "sending no content"))
 		}
 		return
 	}
 
-	err = c.JSON(code, message)
+	// the response depends on who is asking so caches have to keep them apart
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	c.Response().Header().Add(echo.HeaderVary, "HX-Request")
+
+	requestID := log.RequestIDFromContext(c.Request().Context())
+	dev := devErrorPages && code >= http.StatusInternalServerError
+	switch {
+	case c.Request().Header.Get("HX-Request") == "true":
+		toastMessage := ae.Message
+		if dev {
+			toastMessage = ae.Error()
+		}
+		// htmx swaps the fragment into the toast region instead of the element it was targeting
+		c.Response().Header().Set("HX-Retarget", "#toasts")
+		c.Response().Header().Set("HX-Reswap", "beforeend")
+		err = render(c, errorpage.Toast(code, toastMessage, ae.Fields, requestID), withStatus(code))
+		if err != nil {
+			logger.Sugar().Error(errors.Wrap(err, "rendering error toast"))
+		}
+		return
+	case acceptsHTML(c.Request()) && dev:
+		err = render(c, errorpage.Dev(newDevError(c, ae, code)), withStatus(code))
+		if err != nil {
+			logger.Sugar().Error(errors.Wrap(err, "rendering developer error page"))
+		}
+		return
+	case acceptsHTML(c.Request()):
+		err = render(c, errorPage(code)(code, ae.Message, requestID), withStatus(code))
+		if err != nil {
+			logger.Sugar().Error(errors.Wrap(err, "rendering error page"))
+		}
+		return
+	}
+
+	err = c.JSON(code, errorResponse{
+		Message:   ae.Message,
+		Code:      ae.Code,
+		Fields:    ae.Fields,
+		RequestID: requestID,
+	})
 	if err != nil {
-		zap.S().Error(errors.Wrap(err, "marshalling json payload"))
+		logger.Sugar().Error(errors.Wrap(err, "marshalling json payload"))
+	}
+}
+
+// errorResponse is the json body of errors
+type errorResponse struct {
+	Message   string              `json:"message"`
+	Code      apperr.Code         `json:"code"`
+	Fields    []apperr.FieldError `json:"fields,omitempty"`
+	RequestID string              `json:"request_id,omitempty"`
+}
+
+// toAppError turns any error into an application error. Echo's errors keep their status and
+// message, anything else is an internal error whose details aren't shown to users.
+func toAppError(err error) *apperr.Error {
+	var ae *apperr.Error
+	if errors.As(err, &ae) {
+		return ae
+	}
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		message := http.StatusText(he.Code)
+		switch m := he.Message.(type) {
+		case string:
+			message = m
+		case error:
+			message = m.Error()
+		}
+		return apperr.FromStatus(he.Code, message, he.Internal)
+	}
+
+	return apperr.FromStatus(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), err)
+}
+
+// ErrorPage renders the full page for an error status. The message is safe to show to users.
+type ErrorPage func(status int, message string, requestID string) templ.Component
+
+var errorPages = map[int]ErrorPage{}
+
+// RegisterErrorPage replaces the error page browsers get for the status. Register pages before
+// the server starts, e.g. handler.RegisterErrorPage(http.StatusNotFound, mypages.NotFound).
+func RegisterErrorPage(status int, page ErrorPage) {
+	errorPages[status] = page
+}
+
+func errorPage(status int) ErrorPage {
+	if page, ok := errorPages[status]; ok {
+		return page
+	}
+	return errorpage.Page
+}
+
+// acceptsHTML reports whether the client prefers html over json, e.g. a browser navigating. Clients
+// that don't say (or accept anything) keep getting json.
+func acceptsHTML(r *http.Request) bool {
+	var htmlQ, jsonQ float64
+	for _, accept := range strings.Split(r.Header.Get(echo.HeaderAccept), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case echo.MIMETextHTML, "application/xhtml+xml":
+			htmlQ = max(htmlQ, q)
+		case echo.MIMEApplicationJSON:
+			jsonQ = max(jsonQ, q)
+		}
 	}
+	return htmlQ > 0 && htmlQ >= jsonQ
 }
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+
+	"github.com/a-h/templ"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	type tc struct {
+		path           string
+		headers        map[string]string
+		expectStatus   int
+		expectType     string
+		expectBody     string
+		expectRetarget string
+	}
+
+	tests := map[string]tc{
+		"json for api clients": {
+			path:         "/missing",
+			headers:      map[string]string{"Accept": "application/json"},
+			expectStatus: http.StatusNotFound,
+			expectType:   echo.MIMEApplicationJSON,
+			expectBody:   `{"message":"Not Found","code":"not_found"}`,
+		},
+		"json when the client doesn't say": {
+			path:         "/missing",
+			expectStatus: http.StatusNotFound,
+			expectType:   echo.MIMEApplicationJSON,
+			expectBody:   `{"message":"Not Found","code":"not_found"}`,
+		},
+		"page for browsers": {
+			path:         "/missing",
+			headers:      map[string]string{"Accept": "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+			expectStatus: http.StatusNotFound,
+			expectType:   echo.MIMETextHTMLCharsetUTF8,
+			expectBody:   "We couldn&#39;t find that page",
+		},
+		"toast for htmx": {
+			path:           "/fail",
+			headers:        map[string]string{"HX-Request": "true", "Accept": "text/html"},
+			expectStatus:   http.StatusInternalServerError,
+			expectType:     echo.MIMETextHTMLCharsetUTF8,
+			expectBody:     `role="alert"`,
+			expectRetarget: "#toasts",
+		},
+		"application errors as json": {
+			path:         "/invalid",
+			headers:      map[string]string{"Accept": "application/json"},
+			expectStatus: http.StatusBadRequest,
+			expectType:   echo.MIMEApplicationJSON,
+			expectBody:   `{"message":"Check your input","code":"invalid_argument","fields":[{"field":"email","message":"is required"}]}`,
+		},
+		"application errors as a toast": {
+			path:           "/invalid",
+			headers:        map[string]string{"HX-Request": "true"},
+			expectStatus:   http.StatusBadRequest,
+			expectType:     echo.MIMETextHTMLCharsetUTF8,
+			expectBody:     "email: is required",
+			expectRetarget: "#toasts",
+		},
+		"hides internal errors": {
+			path:         "/internal",
+			headers:      map[string]string{"Accept": "application/json"},
+			expectStatus: http.StatusInternalServerError,
+			expectType:   echo.MIMEApplicationJSON,
+			expectBody:   `{"message":"Internal Server Error","code":"internal"}`,
+		},
+		"registered page": {
+			path:         "/forbidden",
+			headers:      map[string]string{"Accept": "text/html"},
+			expectStatus: http.StatusForbidden,
+			expectType:   echo.MIMETextHTMLCharsetUTF8,
+			expectBody:   "custom forbidden: Forbidden",
+		},
+	}
+
+	RegisterErrorPage(http.StatusForbidden, func(status int, message string, requestID string) templ.Component {
+		return templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+			_, err := io.WriteString(w, "custom forbidden: "+message)
+			return err
+		})
+	})
+	defer delete(errorPages, http.StatusForbidden)
+
+	e := echo.New()
+	e.HTTPErrorHandler = Error
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	})
+	e.GET("/forbidden", func(c echo.Context) error {
+		return echo.ErrForbidden
+	})
+	e.GET("/invalid", func(c echo.Context) error {
+		return apperr.New(apperr.CodeInvalidArgument, "Check your input").WithField("email", "is required")
+	})
+	e.GET("/internal", func(c echo.Context) error {
+		return errors.New("db password is hunter2")
+	})
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			assert.Equal(t, tc.expectType, rec.Header().Get(echo.HeaderContentType))
+			assert.Contains(t, rec.Body.String(), tc.expectBody)
+			assert.NotContains(t, rec.Body.String(), "hunter2")
+			assert.Equal(t, tc.expectRetarget, rec.Header().Get("HX-Retarget"))
+		})
+	}
+}
+
+func loadUser() error {
+	return errors.New("user table is missing") // the line the dev page points at
+}
+
+func TestDevErrorPage(t *testing.T) {
+	EnableDevErrorPages(true)
+	defer EnableDevErrorPages(false)
+
+	e := echo.New()
+	e.HTTPErrorHandler = Error
+	e.GET("/users/:id", func(c echo.Context) error {
+		return errors.Wrap(loadUser(), "rendering profile")
+	})
+
+	// the page shows the source of this test, so the secret must not appear in it as is
+	secret := strings.ToUpper("hunter2")
+	email := "alice" + "@" + "example.com"
+	req := httptest.NewRequest(http.MethodGet, "/users/42?tab=settings&token="+secret+"&new_password="+secret+"&email="+email, nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("X-Custom", "hello")
+	req.Header.Set("Authorization", "Bearer "+secret)
+	req.AddCookie(&http.Cookie{Name: "session", Value: secret})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"rendering profile: user table is missing",
+		"/users/:id",
+		"handler.loadUser",
+		"the line the dev page points at",
+		"path id", "42",
+		"query tab", "settings",
+		"query new_password", "query email",
+		"X-Custom", "hello",
+	} {
+		assert.Contains(t, body, expected)
+	}
+
+	// credentials are never shown
+	assert.NotContains(t, body, secret)
+	assert.NotContains(t, body, email)
+}
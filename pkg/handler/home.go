@@ -5,18 +5,23 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/grindlemire/gothem-stack/pkg/log"
+	"github.com/grindlemire/gothem-stack/pkg/metrics"
 	"github.com/grindlemire/gothem-stack/web/pages/home"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
-	"go.uber.org/zap"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type HomeHandler struct {
 	// you could put a database handle here or any dependencies you want
+
+	randomStrings *prometheus.CounterVec
 }
 
 func NewHomeHandler() (h *HomeHandler, err error) {
-	return &HomeHandler{}, nil
+	return &HomeHandler{
+		randomStrings: metrics.NewCounter("random_strings_generated_total", "Count of random strings generated."),
+	}, nil
 }
 
 // RegisterRoutes registers all the subroutes for the home handler to manage
@@ -34,10 +39,12 @@ func (h *HomeHandler) GetRandomString(c echo.Context) error {
 
 	err := DoThing()
 	if err != nil {
-		zap.L().Info("example error", log.Callers(err)...)
-		// zap.L().Info("example error with stacktrace", log.Callers(err, log.WithStack())...)
+		logger := log.FromContext(c.Request().Context())
+		logger.Info("example error", log.Callers(err)...)
+		// logger.Info("example error with stacktrace", log.Callers(err, log.WithStack())...)
 	}
 
+	h.randomStrings.WithLabelValues().Inc()
 	return render(c, home.RandomString(uuid.NewString()))
 }
 
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/grindlemire/gothem-stack/pkg/errtrack"
+	"github.com/grindlemire/gothem-stack/web/pages/inbox"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// InboxHandler serves the captured server errors grouped by fingerprint
+type InboxHandler struct {
+	store *errtrack.Store
+}
+
+func NewInboxHandler(store *errtrack.Store) (h *InboxHandler, err error) {
+	return &InboxHandler{
+		store: store,
+	}, nil
+}
+
+// RegisterRoutes registers all the subroutes for the inbox handler to manage. The group should
+// be protected, stacks and request metadata are not for everyone to see.
+func (h *InboxHandler) RegisterRoutes(g *echo.Group) {
+	g.GET("", h.RenderInbox)
+	g.GET("/:fingerprint", h.RenderGroup)
+	g.DELETE("/:fingerprint", h.ResolveGroup)
+}
+
+func (h *InboxHandler) RenderInbox(c echo.Context) error {
+	return render(c, inbox.List(h.store.Groups()))
+}
+
+func (h *InboxHandler) RenderGroup(c echo.Context) error {
+	fingerprint := c.Param("fingerprint")
+	g, ok := h.store.Group(fingerprint)
+	if !ok {
+		return echo.ErrNotFound.SetInternal(errors.Errorf("no error group | fingerprint=[%s]", fingerprint))
+	}
+	return render(c, inbox.Detail(g))
+}
+
+func (h *InboxHandler) ResolveGroup(c echo.Context) error {
+	h.store.Resolve(c.Param("fingerprint"))
+
+	// resolving from the detail page goes back to the list, from the list the row is just removed
+	if c.Request().Header.Get("HX-Target") == "group" {
+		c.Response().Header().Set("HX-Redirect", "/errors")
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/grindlemire/gothem-stack/pkg/errtrack"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+	"github.com/grindlemire/gothem-stack/pkg/metrics"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+var panics = metrics.NewCounter("http_panics_recovered_total", "Count of panics recovered from handlers.", "route")
+
+// Recover turns panics in handlers into errors carrying the stack of the panic and returns them
+// so Error logs, captures and renders them like any other server error.
+//
+// If the handler already wrote part of the response, e.g. a templ component panicked halfway
+// through rendering, it is too late for an error page. The panic is logged and captured here and
+// the connection is aborted so the client doesn't mistake the partial page for a complete one.
+func Recover() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				// net/http aborts the response without logging for this one, so should we
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
+
+				cause, ok := r.(error)
+				if !ok {
+					cause = fmt.Errorf("%v", r)
+				}
+				// this must be called right here so the panicking frames are still on the stack
+				err = errtrack.Panic(cause)
+				panics.WithLabelValues(c.Path()).Inc()
+
+				if c.Response().Committed {
+					abort(c, err, "panic after the response was written")
+				}
+			}()
+
+			return next(c)
+		}
+	}
+}
+
+// abort logs and captures err and then aborts the response. Use it for failures after part of the
+// response was written, when it is too late for an error page.
+func abort(c echo.Context, err error, message string) {
+	log.FromContext(c.Request().Context()).Error(
+		message,
+		append(log.Callers(err, log.WithStack()), zap.Int64("bytes", c.Response().Size))...,
+	)
+	errtrack.Default().Capture(errtrack.NewEvent(c, err, c.Response().Status))
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-h/templ"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRecover(t *testing.T) {
+	type tc struct {
+		path         string
+		expectAbort  bool
+		expectStatus int
+		expectLog    string
+	}
+
+	tests := map[string]tc{
+		"renders an error for panics": {
+			path:         "/panic",
+			expectStatus: http.StatusInternalServerError,
+			expectLog:    "Internal Server Error: panic: boom",
+		},
+		"aborts panics after the response was written": {
+			path:        "/partial",
+			expectAbort: true,
+			expectLog:   "panic after the response was written",
+		},
+		"passes aborts through": {
+			path:        "/abort",
+			expectAbort: true,
+		},
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = Error
+	e.Use(Recover())
+	e.GET("/panic", func(c echo.Context) error {
+		panic("boom")
+	})
+	e.GET("/partial", func(c echo.Context) error {
+		return render(c, templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+			_, _ = io.WriteString(w, "<html><body>half a page")
+			w.(http.Flusher).Flush()
+			panic("boom")
+		}), streaming())
+	})
+	e.GET("/abort", func(c echo.Context) error {
+		panic(http.ErrAbortHandler)
+	})
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			core, logs := observer.New(zap.DebugLevel)
+			restore := zap.ReplaceGlobals(zap.New(core))
+			defer restore()
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+
+			if tc.expectAbort {
+				assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+					e.ServeHTTP(rec, req)
+				})
+			} else {
+				e.ServeHTTP(rec, req)
+				assert.Equal(t, tc.expectStatus, rec.Code)
+			}
+
+			if tc.expectLog == "" {
+				assert.Empty(t, logs.All())
+				return
+			}
+			entries := logs.FilterMessage(tc.expectLog).All()
+			require.Len(t, entries, 1)
+			// the stack starts in the handler that panicked
+			assert.Contains(t, entries[0].ContextMap()["err_func"], "TestRecover")
+		})
+	}
+}
@@ -1,10 +1,119 @@
 package handler
 
 import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/log"
+	"github.com/grindlemire/gothem-stack/pkg/metrics"
+	"github.com/grindlemire/gothem-stack/pkg/tracing"
+
 	"github.com/a-h/templ"
 	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/codes"
 )
 
-func render(c echo.Context, component templ.Component) error {
-	return component.Render(c.Request().Context(), c.Response().Writer)
+// maxPooledBuffer keeps the occasional huge page from pinning its buffer in the pool forever
+const maxPooledBuffer = 1 << 20
+
+var buffers = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+type renderOptions struct {
+	status  int
+	headers http.Header
+	stream  bool
+}
+
+type renderOption func(*renderOptions)
+
+// withStatus responds with status instead of 200
+func withStatus(status int) renderOption {
+	return func(o *renderOptions) {
+		o.status = status
+	}
+}
+
+// withHeader sets a response header, e.g. HX-Trigger. Headers are only sent if rendering succeeds.
+func withHeader(key, value string) renderOption {
+	return func(o *renderOptions) {
+		o.headers.Set(key, value)
+	}
+}
+
+// streaming writes the component to the client while it renders instead of buffering all of it.
+// Use it for large pages and put @templ.Flush() in the component wherever the client should get
+// what has been rendered so far. The status and headers are sent before rendering, so a failure
+// halfway through can't become an error page and aborts the response instead.
+func streaming() renderOption {
+	return func(o *renderOptions) {
+		o.stream = true
+	}
+}
+
+// render renders the component as html. By default it renders into a pooled buffer first so a
+// failure becomes a proper error response rather than a truncated page.
+func render(c echo.Context, component templ.Component, opts ...renderOption) error {
+	o := renderOptions{status: http.StatusOK, headers: http.Header{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.ObserveRender(c.Path(), start)
+		log.RecordTiming(c.Request().Context(), "render", time.Since(start))
+	}()
+
+	ctx, span := tracing.Start(c.Request().Context(), "render "+c.Path())
+	defer span.End()
+
+	if o.stream {
+		writeHeader(c, o)
+		err := component.Render(ctx, c.Response())
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			abort(c, errors.Wrap(err, "streaming component"), "rendering failed after the response was written")
+		}
+		c.Response().Flush()
+		return nil
+	}
+
+	buf := buffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			buf.Reset()
+			buffers.Put(buf)
+		}
+	}()
+
+	err := component.Render(ctx, buf)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return errors.Wrap(err, "rendering component")
+	}
+
+	writeHeader(c, o)
+	_, err = buf.WriteTo(c.Response())
+	return errors.Wrap(err, "writing response")
+}
+
+// writeHeader sends the status and headers. The content type always carries the charset and
+// browsers may not sniff it, so user content can't be interpreted as something else.
+func writeHeader(c echo.Context, o renderOptions) {
+	h := c.Response().Header()
+	for k, vs := range o.headers {
+		h[k] = vs
+	}
+	h.Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	h.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	c.Response().WriteHeader(o.status)
 }
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-h/templ"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRender(t *testing.T) {
+	type tc struct {
+		component    templ.Component
+		opts         []renderOption
+		expectErr    bool
+		expectAbort  bool
+		expectStatus int
+		expectBody   string
+		expectHeader string
+	}
+
+	hello := templ.Raw("<p>hello</p>")
+	failing := templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+		_, _ = io.WriteString(w, "<p>half")
+		return errors.New("template failed")
+	})
+
+	tests := map[string]tc{
+		"renders html": {
+			component:    hello,
+			expectStatus: http.StatusOK,
+			expectBody:   "<p>hello</p>",
+		},
+		"sets the status and headers": {
+			component:    hello,
+			opts:         []renderOption{withStatus(http.StatusCreated), withHeader("HX-Trigger", "created")},
+			expectStatus: http.StatusCreated,
+			expectBody:   "<p>hello</p>",
+			expectHeader: "created",
+		},
+		"writes nothing when rendering fails": {
+			component: failing,
+			opts:      []renderOption{withHeader("HX-Trigger", "created")},
+			expectErr: true,
+		},
+		"streams": {
+			component:    hello,
+			opts:         []renderOption{streaming(), withStatus(http.StatusAccepted)},
+			expectStatus: http.StatusAccepted,
+			expectBody:   "<p>hello</p>",
+		},
+		"aborts when streaming fails": {
+			component:    failing,
+			opts:         []renderOption{streaming()},
+			expectAbort:  true,
+			expectStatus: http.StatusOK,
+			expectBody:   "<p>half",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+			if tc.expectAbort {
+				// the status is already sent so the connection is cut instead of an error page
+				assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+					_ = render(c, tc.component, tc.opts...)
+				})
+				assert.Equal(t, tc.expectStatus, rec.Code)
+				assert.Equal(t, tc.expectBody, rec.Body.String())
+				return
+			}
+
+			err := render(c, tc.component, tc.opts...)
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.False(t, c.Response().Committed)
+				assert.Empty(t, rec.Body.String())
+				assert.Empty(t, rec.Header().Get("HX-Trigger"))
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectStatus, rec.Code)
+			assert.Equal(t, tc.expectBody, rec.Body.String())
+			assert.Equal(t, tc.expectHeader, rec.Header().Get("HX-Trigger"))
+			assert.Equal(t, echo.MIMETextHTMLCharsetUTF8, rec.Header().Get(echo.HeaderContentType))
+			assert.Equal(t, "nosniff", rec.Header().Get(echo.HeaderXContentTypeOptions))
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+	statusDraining    = "draining"
+)
+
+// Check reports whether a dependency is able to serve traffic. Checks should return
+// promptly once the context is cancelled.
+type Check func(ctx context.Context) error
+
+// Registry holds the dependency checks for the process and tracks whether we are draining
+// in preparation for shutdown.
+type Registry struct {
+	timeout  time.Duration
+	draining atomic.Bool
+
+	mu     sync.RWMutex
+	checks map[string]Check
+}
+
+// Response is the body returned by the liveness and readiness endpoints
+type Response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// NewRegistry creates a registry where each readiness check is given at most timeout to complete
+func NewRegistry(timeout time.Duration) *Registry {
+	return &Registry{
+		timeout: timeout,
+		checks:  map[string]Check{},
+	}
+}
+
+// Register adds a named dependency check that must pass for the process to be ready.
+// Registering the same name twice replaces the previous check.
+func (r *Registry) Register(name string, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = check
+}
+
+// Drain marks the process as going away so readiness starts failing and load balancers
+// stop sending new traffic
+func (r *Registry) Drain() {
+	r.draining.Store(true)
+}
+
+// Draining reports whether Drain has been called
+func (r *Registry) Draining() bool {
+	return r.draining.Load()
+}
+
+// RegisterRoutes registers the liveness and readiness endpoints
+func (r *Registry) RegisterRoutes(e *echo.Echo) {
+	e.GET("/healthz", r.Liveness)
+	e.GET("/readyz", r.Readiness)
+}
+
+// Liveness reports that the process is up. It never runs dependency checks because a failing
+// dependency should not cause the orchestrator to restart us.
+func (r *Registry) Liveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, Response{Status: statusOK})
+}
+
+// Readiness runs every registered check and reports whether we should receive traffic
+func (r *Registry) Readiness(c echo.Context) error {
+	if r.Draining() {
+		return c.JSON(http.StatusServiceUnavailable, Response{Status: statusDraining})
+	}
+
+	resp := r.run(c.Request().Context())
+	if resp.Status != statusOK {
+		return c.JSON(http.StatusServiceUnavailable, resp)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// run executes all the checks concurrently and collects their results
+func (r *Registry) run(ctx context.Context) Response {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.checks))
+	checks := make([]Check, 0, len(r.checks))
+	for name := range r.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks, r.checks[name])
+	}
+	r.mu.RUnlock()
+
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	errs := make([]error, len(checks))
+	wg := sync.WaitGroup{}
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			errs[i] = check(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	resp := Response{Status: statusOK, Checks: map[string]string{}}
+	for i, name := range names {
+		if errs[i] != nil {
+			zap.S().Warnf("readiness check %s failed: %v", name, errs[i])
+			resp.Status = statusUnavailable
+			resp.Checks[name] = errs[i].Error()
+			continue
+		}
+		resp.Checks[name] = statusOK
+	}
+	return resp
+}
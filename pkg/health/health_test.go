@@ -0,0 +1,107 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	type tc struct {
+		checks         map[string]Check
+		drain          bool
+		expectedCode   int
+		expectedStatus string
+		expectedChecks map[string]string
+	}
+
+	tests := map[string]tc{
+		"no checks": {
+			expectedCode:   http.StatusOK,
+			expectedStatus: statusOK,
+		},
+		"passing checks": {
+			checks: map[string]Check{
+				"db": func(ctx context.Context) error { return nil },
+			},
+			expectedCode:   http.StatusOK,
+			expectedStatus: statusOK,
+			expectedChecks: map[string]string{"db": statusOK},
+		},
+		"failing check": {
+			checks: map[string]Check{
+				"db":    func(ctx context.Context) error { return nil },
+				"queue": func(ctx context.Context) error { return errors.New("connection refused") },
+			},
+			expectedCode:   http.StatusServiceUnavailable,
+			expectedStatus: statusUnavailable,
+			expectedChecks: map[string]string{"db": statusOK, "queue": "connection refused"},
+		},
+		"check exceeds timeout": {
+			checks: map[string]Check{
+				"slow": func(ctx context.Context) error {
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			},
+			expectedCode:   http.StatusServiceUnavailable,
+			expectedStatus: statusUnavailable,
+			expectedChecks: map[string]string{"slow": context.DeadlineExceeded.Error()},
+		},
+		"draining": {
+			checks: map[string]Check{
+				"db": func(ctx context.Context) error { return nil },
+			},
+			drain:          true,
+			expectedCode:   http.StatusServiceUnavailable,
+			expectedStatus: statusDraining,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := NewRegistry(10 * time.Millisecond)
+			for name, check := range tc.checks {
+				r.Register(name, check)
+			}
+			if tc.drain {
+				r.Drain()
+			}
+
+			e := echo.New()
+			r.RegisterRoutes(e)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tc.expectedCode, rec.Code)
+
+			var resp Response
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, tc.expectedStatus, resp.Status)
+			if tc.expectedChecks != nil {
+				assert.Equal(t, tc.expectedChecks, resp.Checks)
+			}
+		})
+	}
+}
+
+func TestLivenessWhileDraining(t *testing.T) {
+	r := NewRegistry(time.Second)
+	r.Register("db", func(ctx context.Context) error { return errors.New("down") })
+	r.Drain()
+
+	e := echo.New()
+	r.RegisterRoutes(e)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
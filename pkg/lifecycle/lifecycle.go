@@ -0,0 +1,182 @@
+package lifecycle
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DefaultStopTimeout is used for hooks that do not set their own StopTimeout
+const DefaultStopTimeout = 15 * time.Second
+
+// Hook is a component participating in the process lifecycle (http servers, db pools, workers, etc.)
+type Hook struct {
+	// Name identifies the component in logs and errors
+	Name string
+	// OnStart starts the component. It must return once the component is started; long running
+	// work should happen in a goroutine that reports failures through Manager.Fail.
+	OnStart func(ctx context.Context) error
+	// OnStop stops the component. The context expires after StopTimeout.
+	OnStop func(ctx context.Context) error
+	// StopTimeout is the deadline for OnStop. Zero means DefaultStopTimeout.
+	StopTimeout time.Duration
+}
+
+// phase is the part of the lifecycle the manager is in, used to report late failures
+type phase string
+
+const (
+	phaseStarting phase = "startup"
+	phaseRunning  phase = "running"
+	phaseStopping phase = "shutdown"
+)
+
+// Manager starts hooks in the order they were appended and stops them in reverse order
+type Manager struct {
+	mu    sync.Mutex
+	hooks []Hook
+	phase phase
+
+	failCh chan error
+}
+
+// New creates an empty lifecycle manager
+func New() *Manager {
+	return &Manager{
+		phase:  phaseStarting,
+		failCh: make(chan error, 1),
+	}
+}
+
+// Append registers a hook. Hooks are started in the order they are appended.
+func (m *Manager) Append(h Hook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, h)
+}
+
+// Fail tells the manager that a started component has failed and the process should shut down.
+// Only the first failure is kept, later ones and failures while stopping are logged.
+func (m *Manager) Fail(name string, err error) {
+	m.mu.Lock()
+	p := m.phase
+	m.mu.Unlock()
+
+	if p != phaseStopping {
+		select {
+		case m.failCh <- errors.Wrapf(err, "component %s failed", name):
+			return
+		default:
+		}
+	}
+	zap.S().Errorf("component %s failed during %s: %v", name, p, err)
+}
+
+func (m *Manager) setPhase(p phase) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.phase = p
+}
+
+// Run starts every hook, waits for the context to be cancelled or a component to fail, and
+// then stops the started hooks in reverse order. If the shutdown was caused by the context
+// the context error is returned unless stopping failed.
+func (m *Manager) Run(ctx context.Context) error {
+	m.mu.Lock()
+	hooks := make([]Hook, len(m.hooks))
+	copy(hooks, m.hooks)
+	m.phase = phaseStarting
+	m.mu.Unlock()
+
+	started, err := m.start(ctx, hooks)
+	if err != nil {
+		m.setPhase(phaseStopping)
+		stopErr := m.stop(started)
+		if stopErr != nil {
+			zap.S().Error(stopErr)
+		}
+		return err
+	}
+
+	m.setPhase(phaseRunning)
+	var runErr error
+	select {
+	case <-ctx.Done():
+		runErr = ctx.Err()
+	case runErr = <-m.failCh:
+		zap.S().Error(runErr)
+	}
+
+	zap.S().Info("shutting down")
+	m.setPhase(phaseStopping)
+	err = m.stop(started)
+	if err != nil {
+		return err
+	}
+	return runErr
+}
+
+// start starts the hooks in order and returns the ones that were successfully started
+func (m *Manager) start(ctx context.Context, hooks []Hook) (started []Hook, err error) {
+	for _, h := range hooks {
+		if h.OnStart != nil {
+			zap.S().Debugf("starting %s", h.Name)
+			err = h.OnStart(ctx)
+			if err != nil {
+				return started, errors.Wrapf(err, "starting %s", h.Name)
+			}
+		}
+		started = append(started, h)
+	}
+	return started, nil
+}
+
+// stop stops the hooks in reverse order, giving each one its own deadline. A hook that does not
+// return before its deadline is abandoned so it cannot block the rest of the shutdown.
+func (m *Manager) stop(hooks []Hook) error {
+	failures := []string{}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		if h.OnStop == nil {
+			continue
+		}
+
+		timeout := h.StopTimeout
+		if timeout <= 0 {
+			timeout = DefaultStopTimeout
+		}
+
+		zap.S().Debugf("stopping %s", h.Name)
+		err := stopHook(h, timeout)
+		if err != nil {
+			zap.S().Errorf("stopping %s: %v", h.Name, err)
+			failures = append(failures, h.Name+": "+err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.Errorf("stopping components | %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func stopHook(h Hook, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.OnStop(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Errorf("blocked shutdown for longer than %s", timeout)
+	}
+}
@@ -0,0 +1,145 @@
+package lifecycle
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// recorder records the order hooks are started and stopped in
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) hook(name string, startErr error, stopDelay time.Duration) Hook {
+	return Hook{
+		Name: name,
+		OnStart: func(ctx context.Context) error {
+			r.record("start " + name)
+			return startErr
+		},
+		OnStop: func(ctx context.Context) error {
+			select {
+			case <-time.After(stopDelay):
+			case <-ctx.Done():
+				// simulate a component that ignores its deadline
+				time.Sleep(stopDelay)
+			}
+			r.record("stop " + name)
+			return nil
+		},
+		StopTimeout: 20 * time.Millisecond,
+	}
+}
+
+func (r *recorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func TestRun(t *testing.T) {
+	type tc struct {
+		hooks          func(r *recorder) []Hook
+		fail           error
+		expectedEvents []string
+		expectedErr    string
+	}
+
+	tests := map[string]tc{
+		"starts in order and stops in reverse": {
+			hooks: func(r *recorder) []Hook {
+				return []Hook{r.hook("db", nil, 0), r.hook("http", nil, 0)}
+			},
+			expectedEvents: []string{"start db", "start http", "stop http", "stop db"},
+			expectedErr:    context.Canceled.Error(),
+		},
+		"start failure stops already started hooks": {
+			hooks: func(r *recorder) []Hook {
+				return []Hook{r.hook("db", nil, 0), r.hook("http", errors.New("address in use"), 0), r.hook("worker", nil, 0)}
+			},
+			expectedEvents: []string{"start db", "start http", "stop db"},
+			expectedErr:    "starting http: address in use",
+		},
+		"component failure triggers shutdown": {
+			hooks: func(r *recorder) []Hook {
+				return []Hook{r.hook("db", nil, 0)}
+			},
+			fail:           errors.New("connection lost"),
+			expectedEvents: []string{"start db", "stop db"},
+			expectedErr:    "component db failed: connection lost",
+		},
+		"blocked component is reported": {
+			hooks: func(r *recorder) []Hook {
+				return []Hook{r.hook("db", nil, 0), r.hook("worker", nil, 200*time.Millisecond)}
+			},
+			expectedEvents: []string{"start db", "start worker", "stop db"},
+			expectedErr:    "stopping components | worker: blocked shutdown for longer than 20ms",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := &recorder{}
+			m := New()
+			for _, h := range tc.hooks(r) {
+				m.Append(h)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.fail != nil {
+				m.Fail("db", tc.fail)
+			} else {
+				cancel()
+			}
+
+			err := m.Run(ctx)
+			assert.EqualError(t, err, tc.expectedErr)
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			assert.Equal(t, tc.expectedEvents, r.events)
+		})
+	}
+}
+
+func TestFailLogsPhase(t *testing.T) {
+	core, logs := observer.New(zap.ErrorLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	m := New()
+	m.Append(Hook{
+		Name: "worker",
+		OnStart: func(ctx context.Context) error {
+			m.Fail("worker", errors.New("first"))
+			m.Fail("worker", errors.New("second"))
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			m.Fail("worker", errors.New("while stopping"))
+			return nil
+		},
+	})
+
+	err := m.Run(context.Background())
+	assert.EqualError(t, err, "component worker failed: first")
+
+	var messages []string
+	for _, entry := range logs.FilterMessageSnippet("failed during").All() {
+		messages = append(messages, entry.Message)
+	}
+	require.Len(t, messages, 2)
+	assert.Equal(t, []string{
+		"component worker failed during startup: second",
+		"component worker failed during shutdown: while stopping",
+	}, messages)
+}
@@ -0,0 +1,140 @@
+package log
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AccessLogConfig controls which requests the access log records
+type AccessLogConfig struct {
+	// SampleRate is the fraction of successful (< 400) requests that are logged. Client errors,
+	// server errors and slow requests are always logged.
+	SampleRate float64
+	// SlowThreshold logs requests that take longer than this at warn with a timing breakdown.
+	// Zero disables slow request detection.
+	SlowThreshold time.Duration
+}
+
+const timingsKey = contextKey("timings")
+
+// timings is the per phase breakdown of where a request spent its time
+type timings struct {
+	mu     sync.Mutex
+	phases []string
+	totals map[string]time.Duration
+}
+
+// RecordTiming adds d to the named phase (e.g. "render", "db") of the request's timing breakdown.
+// The breakdown is logged for slow requests. It does nothing outside of a request.
+func RecordTiming(ctx context.Context, phase string, d time.Duration) {
+	t, ok := ctx.Value(timingsKey).(*timings)
+	if !ok {
+		return
+	}
+	t.record(phase, d)
+}
+
+func (t *timings) record(phase string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.totals[phase]; !ok {
+		t.phases = append(t.phases, phase)
+	}
+	t.totals[phase] += d
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (t *timings) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, phase := range t.phases {
+		enc.AddDuration(phase, t.totals[phase])
+	}
+	return nil
+}
+
+// AccessLog logs a line per request with the request logger from Middleware, so it must be
+// registered after it. Successful requests are sampled, every 4xx and 5xx is logged, and requests
+// slower than the threshold are logged at warn with a timing breakdown. Responses aborted with
+// http.ErrAbortHandler, e.g. when streaming fails halfway through, are logged at error.
+func AccessLog(config AccessLogConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+
+			t := &timings{totals: map[string]time.Duration{}}
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), timingsKey, t)))
+			c.Response().Before(func() {
+				t.record("first_byte", time.Since(start))
+			})
+
+			defer func() {
+				if r := recover(); r != nil {
+					// the server cuts the connection once the panic reaches it, log the request first
+					logRequest(c, config, start, t, true)
+					panic(r)
+				}
+			}()
+
+			err := next(c)
+			if err != nil {
+				// run the error handler now so we log the status that is actually sent. The error is
+				// still returned for the middleware above us; the error handler ignores it once the
+				// response is committed.
+				c.Error(err)
+			}
+			logRequest(c, config, start, t, false)
+			return err
+		}
+	}
+}
+
+// logRequest writes the access log line of the request unless it is sampled out
+func logRequest(c echo.Context, config AccessLogConfig, start time.Time, t *timings, aborted bool) {
+	req := c.Request()
+	latency := time.Since(start)
+	status := c.Response().Status
+	slow := config.SlowThreshold > 0 && latency > config.SlowThreshold
+	if status < http.StatusBadRequest && !slow && !aborted && rand.Float64() >= config.SampleRate {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.Int("status", status),
+		zap.Duration("latency", latency),
+		zap.Int64("bytes", c.Response().Size),
+		zap.String("path", req.URL.Path),
+		zap.String("client_ip", c.RealIP()),
+		// the peer is logged too since the client ip may come from a forwarding header
+		zap.String("remote_addr", req.RemoteAddr),
+		zap.String("user_agent", req.UserAgent()),
+	}
+	if req.Header.Get("HX-Request") == "true" {
+		fields = append(fields,
+			zap.Bool("hx_request", true),
+			zap.String("hx_target", req.Header.Get("HX-Target")),
+		)
+	}
+
+	logger := FromContext(req.Context())
+	switch {
+	case aborted:
+		// the status was sent before the response failed, so it doesn't tell
+		logger.Error("aborted request", fields...)
+	case status >= http.StatusInternalServerError:
+		logger.Error("request", fields...)
+	case slow:
+		t.record("total", latency)
+		logger.Warn("slow request", append(fields, zap.Object("timings", t))...)
+	default:
+		logger.Info("request", fields...)
+	}
+}
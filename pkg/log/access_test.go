@@ -0,0 +1,153 @@
+package log
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLog(t *testing.T) {
+	type tc struct {
+		path          string
+		config        AccessLogConfig
+		htmx          bool
+		expectAbort   bool
+		expectLogged  bool
+		expectLevel   zapcore.Level
+		expectMessage string
+		expectStatus  int64
+	}
+
+	tests := map[string]tc{
+		"logs successful requests": {
+			path:          "/ok",
+			config:        AccessLogConfig{SampleRate: 1},
+			expectLogged:  true,
+			expectLevel:   zap.InfoLevel,
+			expectMessage: "request",
+			expectStatus:  http.StatusOK,
+		},
+		"samples successful requests": {
+			path:   "/ok",
+			config: AccessLogConfig{SampleRate: 0},
+		},
+		"always logs client errors": {
+			path:          "/missing",
+			config:        AccessLogConfig{SampleRate: 0},
+			expectLogged:  true,
+			expectLevel:   zap.InfoLevel,
+			expectMessage: "request",
+			expectStatus:  http.StatusNotFound,
+		},
+		"logs server errors at error": {
+			path:          "/fail",
+			config:        AccessLogConfig{SampleRate: 0},
+			expectLogged:  true,
+			expectLevel:   zap.ErrorLevel,
+			expectMessage: "request",
+			expectStatus:  http.StatusServiceUnavailable,
+		},
+		"logs slow requests at warn": {
+			path:          "/slow",
+			config:        AccessLogConfig{SampleRate: 0, SlowThreshold: time.Millisecond},
+			expectLogged:  true,
+			expectLevel:   zap.WarnLevel,
+			expectMessage: "slow request",
+			expectStatus:  http.StatusOK,
+		},
+		"logs aborted responses": {
+			path:          "/abort",
+			config:        AccessLogConfig{SampleRate: 0},
+			expectAbort:   true,
+			expectLogged:  true,
+			expectLevel:   zap.ErrorLevel,
+			expectMessage: "aborted request",
+			expectStatus:  http.StatusOK,
+		},
+		"logs htmx headers": {
+			path:          "/ok",
+			config:        AccessLogConfig{SampleRate: 1},
+			htmx:          true,
+			expectLogged:  true,
+			expectLevel:   zap.InfoLevel,
+			expectMessage: "request",
+			expectStatus:  http.StatusOK,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			core, logs := observer.New(zap.DebugLevel)
+			restore := zap.ReplaceGlobals(zap.New(core))
+			defer restore()
+
+			e := echo.New()
+			e.Use(Middleware(), AccessLog(tc.config))
+			e.GET("/ok", func(c echo.Context) error {
+				return c.String(http.StatusOK, "ok")
+			})
+			e.GET("/missing", func(c echo.Context) error {
+				return echo.ErrNotFound
+			})
+			e.GET("/fail", func(c echo.Context) error {
+				return echo.ErrServiceUnavailable
+			})
+			e.GET("/abort", func(c echo.Context) error {
+				_ = c.String(http.StatusOK, "half")
+				panic(http.ErrAbortHandler)
+			})
+			e.GET("/slow", func(c echo.Context) error {
+				time.Sleep(5 * time.Millisecond)
+				RecordTiming(c.Request().Context(), "render", 2*time.Millisecond)
+				return c.String(http.StatusOK, "slow")
+			})
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.htmx {
+				req.Header.Set("HX-Request", "true")
+				req.Header.Set("HX-Target", "#content")
+			}
+			if tc.expectAbort {
+				assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+					e.ServeHTTP(httptest.NewRecorder(), req)
+				})
+			} else {
+				e.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			entries := logs.All()
+			if !tc.expectLogged {
+				assert.Empty(t, entries)
+				return
+			}
+			require.Len(t, entries, 1)
+			assert.Equal(t, tc.expectLevel, entries[0].Level)
+			assert.Equal(t, tc.expectMessage, entries[0].Message)
+
+			fields := entries[0].ContextMap()
+			assert.Equal(t, tc.expectStatus, fields["status"])
+			assert.Equal(t, tc.path, fields["route"])
+			assert.NotEmpty(t, fields["request_id"])
+			assert.Equal(t, req.RemoteAddr, fields["remote_addr"])
+			if tc.htmx {
+				assert.Equal(t, true, fields["hx_request"])
+				assert.Equal(t, "#content", fields["hx_target"])
+			}
+			if tc.expectLevel == zap.WarnLevel {
+				breakdown, ok := fields["timings"].(map[string]interface{})
+				require.True(t, ok)
+				assert.Contains(t, breakdown, "first_byte")
+				assert.Contains(t, breakdown, "render")
+				assert.Contains(t, breakdown, "total")
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package log
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+type contextKey string
+
+const loggerKey = contextKey("logger")
+
+// NewContext returns a context carrying the logger. Use it to attach request scoped fields that
+// every log line emitted during the request should have.
+func NewContext(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger stored in the context, falling back to the global logger
+func FromContext(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*zap.Logger); ok {
+		return logger
+	}
+	return zap.L()
+}
@@ -0,0 +1,228 @@
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type stackTracer interface {
+	StackTrace() errors.StackTrace
+}
+
+type stackOpt struct {
+	withStack bool
+}
+
+type opt func(*stackOpt)
+
+func WithStack() opt {
+	return func(o *stackOpt) {
+		o.withStack = true
+	}
+}
+
+// ErrorDetails is what we can learn about an error by walking its whole cause tree: pkg/errors
+// causes, %w chains and errors.Join. It implements zapcore.ObjectMarshaler so it can be logged as
+// a single field with Err.
+type ErrorDetails struct {
+	// Message is the full message of the error
+	Message string
+	// Messages is the message each wrap layer added, outermost first. Layers that only add a
+	// stack are skipped and joined errors are listed one after another.
+	Messages []string
+	// Caller and Func are the first frame of the deepest stack, i.e. where the root cause happened
+	Caller string
+	Func   string
+	// Stack is the deepest stack in the tree, formatted one frame per function and file:line pair
+	Stack string
+	// Frames is the deepest stack, one entry per frame
+	Frames []Frame
+	// Fingerprint is a stable hash of the root cause type and the functions on its stack. It is
+	// the same for every occurrence of a failure so they can be grouped.
+	Fingerprint string
+
+	withStack bool
+}
+
+// Inspect walks the cause tree of err
+func Inspect(err error, opts ...opt) ErrorDetails {
+	o := &stackOpt{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	d := ErrorDetails{withStack: o.withStack}
+	if err == nil {
+		return d
+	}
+	d.Message = err.Error()
+
+	w := &walker{stackDepth: -1, rootDepth: -1}
+	w.walk(err, 0)
+	d.Messages = w.messages
+
+	var frames []string
+	if w.stack != nil {
+		for i, f := range w.stack.StackTrace() {
+			if i == 0 {
+				d.Caller = fmt.Sprintf("%s:%d", f, f)
+				d.Func = fmt.Sprintf("%n", f)
+			}
+			d.Stack = fmt.Sprintf("%s%+s:%d\n", d.Stack, f, f)
+			frames = append(frames, fmt.Sprintf("%s %n", f, f))
+			d.Frames = append(d.Frames, newFrame(f))
+		}
+	}
+	d.Fingerprint = fingerprint(w.root, frames)
+
+	return d
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (d ErrorDetails) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("message", d.Message)
+	enc.AddString("caller", d.Caller)
+	enc.AddString("func", d.Func)
+	enc.AddString("fingerprint", d.Fingerprint)
+	err := enc.AddArray("messages", messages(d.Messages))
+	if err != nil {
+		return err
+	}
+	if d.withStack {
+		enc.AddString("stack", d.Stack)
+	}
+	return nil
+}
+
+// Err logs the details of err as a single structured field named error
+func Err(err error, opts ...opt) zap.Field {
+	return zap.Object("error", Inspect(err, opts...))
+}
+
+// Callers returns the details of err as flat fields. The err_stack field is only added with WithStack.
+func Callers(err error, opts ...opt) []zap.Field {
+	d := Inspect(err, opts...)
+
+	fields := []zap.Field{
+		zap.String("err_caller", d.Caller),
+		zap.String("err_func", d.Func),
+		zap.String("err_fingerprint", d.Fingerprint),
+		zap.Array("err_messages", messages(d.Messages)),
+	}
+
+	if d.withStack {
+		fields = append(fields, zap.String("err_stack", d.Stack))
+	}
+
+	return fields
+}
+
+// Frame is a single frame of a stack
+type Frame struct {
+	Func string
+	File string
+	Line int
+}
+
+func newFrame(f errors.Frame) Frame {
+	// a stack frame is the return address, the call is the instruction before it
+	pc := uintptr(f) - 1
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return Frame{Func: "unknown"}
+	}
+	file, line := fn.FileLine(pc)
+	return Frame{Func: fn.Name(), File: file, Line: line}
+}
+
+// messages are the messages of the wrap layers. It is its own type so the redaction core can
+// scrub it.
+type messages []string
+
+func (m messages) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, s := range m {
+		enc.AppendString(s)
+	}
+	return nil
+}
+
+// walker collects the layer messages, the deepest stack and the root cause of a cause tree
+type walker struct {
+	messages   []string
+	stack      stackTracer
+	stackDepth int
+	root       error
+	rootDepth  int
+}
+
+func (w *walker) walk(err error, depth int) {
+	if st, ok := err.(stackTracer); ok && depth > w.stackDepth {
+		w.stack, w.stackDepth = st, depth
+	}
+
+	causes := unwrap(err)
+	if len(causes) == 0 {
+		if depth > w.rootDepth {
+			w.root, w.rootDepth = err, depth
+		}
+		w.messages = append(w.messages, err.Error())
+		return
+	}
+
+	// a single cause is usually wrapped as "<message>: <cause>", only keep what this layer added.
+	// joined errors don't add anything of their own.
+	if len(causes) == 1 {
+		msg, cause := err.Error(), causes[0].Error()
+		if msg != cause {
+			w.messages = append(w.messages, strings.TrimSuffix(strings.TrimSuffix(msg, cause), ": "))
+		}
+	}
+
+	for _, cause := range causes {
+		w.walk(cause, depth+1)
+	}
+}
+
+// unwrap returns the direct causes of err from the standard library Unwrap methods or pkg/errors Cause
+func unwrap(err error) []error {
+	var causes []error
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		causes = e.Unwrap()
+	case interface{ Unwrap() error }:
+		causes = []error{e.Unwrap()}
+	case interface{ Cause() error }:
+		causes = []error{e.Cause()}
+	}
+
+	out := causes[:0]
+	for _, c := range causes {
+		if c != nil {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// fingerprint hashes the type of the root cause with the files and functions on the stack. Line
+// numbers and paths are left out so the fingerprint survives unrelated edits and other build
+// machines. Without a stack the root message stands in for it.
+func fingerprint(root error, frames []string) string {
+	h := sha256.New()
+	fmt.Fprintln(h, reflect.TypeOf(root))
+	if len(frames) == 0 {
+		fmt.Fprintln(h, root.Error())
+	}
+	for _, f := range frames {
+		fmt.Fprintln(h, f)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	stderrors "errors"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func rootCause() error {
+	return errors.New("connection refused")
+}
+
+func otherRootCause() error {
+	return errors.New("connection refused")
+}
+
+func TestInspect(t *testing.T) {
+	type tc struct {
+		err            error
+		expectMessages []string
+		expectFunc     string
+	}
+
+	tests := map[string]tc{
+		"pkg/errors wraps": {
+			err:            errors.Wrap(errors.Wrap(rootCause(), "dialing db"), "loading user"),
+			expectMessages: []string{"loading user", "dialing db", "connection refused"},
+			expectFunc:     "rootCause",
+		},
+		"standard library %w chain": {
+			err:            fmt.Errorf("loading user: %w", fmt.Errorf("dialing db: %w", rootCause())),
+			expectMessages: []string{"loading user", "dialing db", "connection refused"},
+			expectFunc:     "rootCause",
+		},
+		"joined errors": {
+			err: stderrors.Join(
+				stderrors.New("closing file"),
+				errors.Wrap(rootCause(), "flushing"),
+			),
+			expectMessages: []string{"closing file", "flushing", "connection refused"},
+			expectFunc:     "rootCause",
+		},
+		"errors without a stack": {
+			err:            fmt.Errorf("loading user: %w", stderrors.New("not found")),
+			expectMessages: []string{"loading user", "not found"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := Inspect(tc.err, WithStack())
+			assert.Equal(t, tc.err.Error(), d.Message)
+			assert.Equal(t, tc.expectMessages, d.Messages)
+			assert.Equal(t, tc.expectFunc, d.Func)
+			assert.Len(t, d.Fingerprint, 16)
+			if tc.expectFunc != "" {
+				assert.Contains(t, d.Caller, "errors_test.go:")
+				assert.Contains(t, d.Stack, "rootCause")
+			} else {
+				assert.Empty(t, d.Caller)
+				assert.Empty(t, d.Stack)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	// the same failure is grouped no matter how it was wrapped
+	first := Inspect(errors.Wrap(rootCause(), "loading user 1"))
+	second := Inspect(fmt.Errorf("loading user 2: %w", rootCause()))
+	assert.Equal(t, first.Fingerprint, second.Fingerprint)
+
+	// the same message from somewhere else is a different failure
+	other := Inspect(otherRootCause())
+	assert.NotEqual(t, first.Fingerprint, other.Fingerprint)
+}
+
+func TestErr(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	zap.New(core).Error("failed", Err(errors.Wrap(rootCause(), "dialing db")))
+
+	fields := logs.All()[0].ContextMap()
+	details, ok := fields["error"].(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, "dialing db: connection refused", details["message"])
+	assert.Equal(t, "rootCause", details["func"])
+	assert.Equal(t, []interface{}{"dialing db", "connection refused"}, details["messages"])
+	assert.NotContains(t, details, "stack")
+}
@@ -0,0 +1,135 @@
+package log
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// special fields understood by Cloud Logging, see https://cloud.google.com/logging/docs/structured-logging
+const (
+	gcpTraceKey          = "logging.googleapis.com/trace"
+	gcpSpanIDKey         = "logging.googleapis.com/spanId"
+	gcpTraceSampledKey   = "logging.googleapis.com/trace_sampled"
+	gcpSourceLocationKey = "logging.googleapis.com/sourceLocation"
+
+	// reportedErrorEvent makes Error Reporting group the entry by its stack_trace
+	reportedErrorEvent = "type.googleapis.com/google.devtools.clouderrorreporting.v1beta1.ReportedErrorEvent"
+)
+
+// gcpEncoderConfig names the keys the way Cloud Logging expects them. The caller is written by
+// gcpCore as a sourceLocation object instead.
+func gcpEncoderConfig() zapcore.EncoderConfig {
+	return zapcore.EncoderConfig{
+		TimeKey:        "timestamp",
+		LevelKey:       "severity",
+		NameKey:        "logger",
+		MessageKey:     "message",
+		StacktraceKey:  "stacktrace",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    encodeSeverity,
+		EncodeTime:     zapcore.RFC3339NanoTimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+		EncodeName:     zapcore.FullNameEncoder,
+	}
+}
+
+// encodeSeverity maps zap levels to the Cloud Logging severities
+func encodeSeverity(l zapcore.Level, enc zapcore.PrimitiveArrayEncoder) {
+	switch l {
+	case zapcore.DebugLevel:
+		enc.AppendString("DEBUG")
+	case zapcore.InfoLevel:
+		enc.AppendString("INFO")
+	case zapcore.WarnLevel:
+		enc.AppendString("WARNING")
+	case zapcore.ErrorLevel:
+		enc.AppendString("ERROR")
+	case zapcore.DPanicLevel:
+		enc.AppendString("CRITICAL")
+	case zapcore.PanicLevel:
+		enc.AppendString("ALERT")
+	case zapcore.FatalLevel:
+		enc.AppendString("EMERGENCY")
+	default:
+		enc.AppendString("DEFAULT")
+	}
+}
+
+// gcpCore rewrites the fields of this package into the special fields of Cloud Logging so entries
+// are linked to their trace, point at their source and show up in Error Reporting.
+type gcpCore struct {
+	zapcore.Core
+	// project turns trace ids into the projects/<project>/traces/<id> form Cloud Logging links on
+	project string
+}
+
+func newGCPCore(core zapcore.Core, project string) zapcore.Core {
+	return &gcpCore{Core: core, project: project}
+}
+
+func (c *gcpCore) With(fields []zapcore.Field) zapcore.Core {
+	return &gcpCore{Core: c.Core.With(c.rewrite(fields)), project: c.project}
+}
+
+func (c *gcpCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *gcpCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	fields = c.rewrite(fields)
+
+	if ent.Caller.Defined {
+		fields = append(fields, zap.Object(gcpSourceLocationKey, sourceLocation(ent.Caller)))
+	}
+
+	// Error Reporting parses go stacks in the format of a panic, which the err_stack of Callers
+	// already is apart from the header
+	for i, f := range fields {
+		if f.Key != "err_stack" || f.String == "" {
+			continue
+		}
+		fields[i] = zap.String("stack_trace", fmt.Sprintf("%s\n\ngoroutine 1 [running]:\n%s", ent.Message, f.String))
+		if ent.Level >= zapcore.ErrorLevel {
+			fields = append(fields, zap.String("@type", reportedErrorEvent))
+		}
+		break
+	}
+
+	return c.Core.Write(ent, fields)
+}
+
+// rewrite renames the trace fields added by TraceFields to the keys Cloud Logging links on
+func (c *gcpCore) rewrite(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, 0, len(fields))
+	for _, f := range fields {
+		switch f.Key {
+		case "trace_id":
+			if c.project != "" {
+				f = zap.String(gcpTraceKey, fmt.Sprintf("projects/%s/traces/%s", c.project, f.String))
+			} else {
+				f.Key = gcpTraceKey
+			}
+		case "span_id":
+			f.Key = gcpSpanIDKey
+		case "trace_sampled":
+			f.Key = gcpTraceSampledKey
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// sourceLocation is the LogEntrySourceLocation of the caller
+type sourceLocation zapcore.EntryCaller
+
+func (s sourceLocation) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("file", s.File)
+	enc.AddInt("line", s.Line)
+	enc.AddString("function", s.Function)
+	return nil
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestGCPCore(t *testing.T) {
+	type tc struct {
+		project        string
+		log            func(logger *zap.Logger)
+		expectSeverity string
+		expectTrace    string
+		expectReported bool
+	}
+
+	traceFields := []zap.Field{
+		zap.String("trace_id", "4bf92f3577b34da6a3ce929d0e0e4736"),
+		zap.String("span_id", "00f067aa0ba902b7"),
+		zap.Bool("trace_sampled", true),
+	}
+
+	tests := map[string]tc{
+		"maps the level to severity": {
+			log: func(logger *zap.Logger) {
+				logger.Warn("careful")
+			},
+			expectSeverity: "WARNING",
+		},
+		"links the trace of the request": {
+			project: "my-project",
+			log: func(logger *zap.Logger) {
+				logger.With(traceFields...).Info("handled")
+			},
+			expectSeverity: "INFO",
+			expectTrace:    "projects/my-project/traces/4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		"keeps the bare trace id without a project": {
+			log: func(logger *zap.Logger) {
+				logger.Info("handled", traceFields...)
+			},
+			expectSeverity: "INFO",
+			expectTrace:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		"reports errors with a stack": {
+			log: func(logger *zap.Logger) {
+				err := errors.New("boom")
+				logger.Error(err.Error(), Callers(err, WithStack())...)
+			},
+			expectSeverity: "ERROR",
+			expectReported: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			core := newGCPCore(
+				zapcore.NewCore(zapcore.NewJSONEncoder(gcpEncoderConfig()), zapcore.AddSync(buf), zap.DebugLevel),
+				tc.project,
+			)
+			tc.log(zap.New(core, zap.AddCaller()))
+
+			var entry map[string]interface{}
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+			assert.Equal(t, tc.expectSeverity, entry["severity"])
+
+			location, ok := entry[gcpSourceLocationKey].(map[string]interface{})
+			require.True(t, ok)
+			assert.Contains(t, location["file"], "gcp_test.go")
+			assert.NotZero(t, location["line"])
+			assert.Contains(t, location["function"], "TestGCPCore")
+
+			if tc.expectTrace != "" {
+				assert.Equal(t, tc.expectTrace, entry[gcpTraceKey])
+				assert.Equal(t, "00f067aa0ba902b7", entry[gcpSpanIDKey])
+				assert.Equal(t, true, entry[gcpTraceSampledKey])
+				assert.NotContains(t, entry, "trace_id")
+			}
+
+			if tc.expectReported {
+				assert.Equal(t, reportedErrorEvent, entry["@type"])
+				assert.Contains(t, entry["stack_trace"], "boom\n\ngoroutine 1 [running]:\n")
+				assert.Contains(t, entry["stack_trace"], "gcp_test.go")
+			} else {
+				assert.NotContains(t, entry, "@type")
+			}
+		})
+	}
+}
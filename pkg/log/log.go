@@ -1,7 +1,6 @@
 package log
 
 import (
-	"fmt"
 	"os"
 	"strings"
 	"time"
@@ -11,97 +10,96 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-// Initializes the log depending on the environment
+// level is shared by every core so the log level can be changed at runtime
+var level = zap.NewAtomicLevel()
+
+// Level returns the global log level. It implements http.Handler so the level can be read with
+// a GET and changed with a PUT of {"level": "debug"}.
+func Level() zap.AtomicLevel {
+	return level
+}
+
+// Log formats selectable with LOG_FORMAT
+const (
+	// FormatConsole is colored human readable output for local development
+	FormatConsole = "console"
+	// FormatJSON is generic zap json
+	FormatJSON = "json"
+	// FormatGCP is json that Cloud Logging understands natively: severities, source locations,
+	// trace correlation and stacks for Error Reporting
+	FormatGCP = "gcp"
+)
+
+// Initializes the log depending on the environment. LOG_FORMAT picks the output format and
+// defaults to json when ENV=prod and console otherwise. GOOGLE_CLOUD_PROJECT is used to link log
+// lines to Cloud Trace in the gcp format. Every format scrubs sensitive values, see
+// DefaultRedactConfig; LOG_REDACT_KEYS and LOG_REDACT_HEADERS add comma separated keys and headers.
 func InitGlobal() error {
-	var core zapcore.Core
+	prod := strings.ToLower(os.Getenv("ENV")) == "prod"
+
+	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
+	if format == "" {
+		format = FormatConsole
+		if prod {
+			format = FormatJSON
+		}
+	}
 
-	var logger *zap.Logger
-	if strings.ToLower(os.Getenv("ENV")) == "prod" {
+	level.SetLevel(zapcore.InfoLevel)
+	debug := strings.ToLower(os.Getenv("DEBUG"))
+	if !prod && (debug == "1" || debug == "true") {
+		level.SetLevel(zapcore.DebugLevel)
+	}
+
+	var encoder zapcore.Encoder
+	switch format {
+	case FormatJSON:
 		zapconf := zap.NewProductionConfig()
 		zapconf.EncoderConfig.FunctionKey = "func"
-		core = zapcore.NewCore(
-			zapcore.NewJSONEncoder(zapconf.EncoderConfig),
-			zapcore.Lock(os.Stdout),
-			zapcore.InfoLevel,
-		)
-
-		logger = zap.New(
-			core,
-			zap.AddCaller(),
-		).Named("prod")
-	} else {
-		// if we are not in gcp use a console logger
+		encoder = zapcore.NewJSONEncoder(zapconf.EncoderConfig)
+	case FormatGCP:
+		encoder = zapcore.NewJSONEncoder(gcpEncoderConfig())
+	case FormatConsole:
 		config := zap.NewDevelopmentConfig()
 		config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 		config.EncoderConfig.EncodeTime = func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
 			enc.AppendString(t.UTC().Format("2006-01-02T15:04:05.000Z"))
 		}
+		encoder = zapcore.NewConsoleEncoder(config.EncoderConfig)
+	default:
+		return errors.Errorf("unknown LOG_FORMAT %q, expected console, json or gcp", format)
+	}
 
-		logLevel := zapcore.InfoLevel
-		debug := strings.ToLower(os.Getenv("DEBUG"))
-		if debug == "1" || debug == "true" {
-			logLevel = zapcore.DebugLevel
-		}
+	redact := DefaultRedactConfig()
+	redact.Keys = append(redact.Keys, splitList(os.Getenv("LOG_REDACT_KEYS"))...)
+	redact.Headers = append(redact.Headers, splitList(os.Getenv("LOG_REDACT_HEADERS"))...)
 
-		core = zapcore.NewCore(
-			zapcore.NewConsoleEncoder(config.EncoderConfig),
-			zapcore.Lock(os.Stdout),
-			logLevel,
-		)
+	// redact right before encoding so nothing added by the cores above slips through
+	core := NewRedactCore(zapcore.NewCore(encoder, zapcore.Lock(os.Stdout), level), redact)
+	if format == FormatGCP {
+		core = newGCPCore(core, os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	}
 
-		logger = zap.New(
-			core,
-			zap.AddCaller(),
-		).Named("dev")
+	name := "dev"
+	if prod {
+		name = "prod"
 	}
+	logger := zap.New(
+		core,
+		zap.AddCaller(),
+	).Named(name)
 
 	zap.ReplaceGlobals(logger)
 	return nil
 }
 
-type stackTracer interface {
-	StackTrace() errors.StackTrace
-}
-
-type stackOpt struct {
-	withStack bool
-}
-
-type opt func(*stackOpt)
-
-func WithStack() opt {
-	return func(o *stackOpt) {
-		o.withStack = true
-	}
-}
-
-func Callers(err error, opts ...opt) []zap.Field {
-	o := &stackOpt{}
-	for _, opt := range opts {
-		opt(o)
-	}
-
-	stack := ""
-	caller := ""
-	fun := ""
-	if err, ok := err.(stackTracer); ok {
-		for i, f := range err.StackTrace() {
-			if i == 0 {
-				caller = fmt.Sprintf("%s:%d", f, f)
-				fun = fmt.Sprintf("%n", f)
-			}
-			stack = fmt.Sprintf("%s%+s:%d\n", stack, f, f)
+// splitList splits a comma separated env value, ignoring empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
 		}
 	}
-
-	fields := []zap.Field{
-		zap.String("err_caller", caller),
-		zap.String("err_func", fun),
-	}
-
-	if o.withStack {
-		fields = append(fields, zap.String("err_stack", stack))
-	}
-
-	return fields
+	return out
 }
@@ -0,0 +1,256 @@
+package log
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted replaces every value scrubbed from the logs
+const Redacted = "[REDACTED]"
+
+// RedactConfig is what the redaction core scrubs before an entry is encoded
+type RedactConfig struct {
+	// Keys are field keys (case insensitive) whose values are always replaced, e.g. password.
+	// They also apply to the keys of url.Values fields so logged form values are scrubbed.
+	Keys []string
+	// Headers are header names whose values are replaced in http.Header fields
+	Headers []string
+	// Patterns are replaced wherever they match in messages, string fields and errors
+	Patterns []*regexp.Regexp
+	// Replacers scrub what a pattern alone can't, e.g. they check a match before redacting it or
+	// keep part of it. They run after the Patterns.
+	Replacers []Replacer
+}
+
+// Replacer replaces every match of Pattern with what Replace returns for it
+type Replacer struct {
+	Pattern *regexp.Regexp
+	Replace func(match string) string
+}
+
+// DefaultRedactConfig scrubs credentials, cookies, emails, bearer tokens, JWTs, token and code url
+// parameters and card numbers
+func DefaultRedactConfig() RedactConfig {
+	return RedactConfig{
+		Keys: []string{
+			"password", "passwd", "secret", "client_secret", "token", "access_token", "refresh_token",
+			"id_token", "api_key", "apikey", "authorization", "cookie", "set-cookie", "session",
+		},
+		Headers: []string{
+			"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key",
+		},
+		Patterns: []*regexp.Regexp{
+			// emails
+			regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`),
+			// bearer and basic credentials
+			regexp.MustCompile(`(?i)\b(bearer|basic)\s+[a-zA-Z0-9._~+/=-]+`),
+			// JWTs
+			regexp.MustCompile(`eyJ[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]*`),
+		},
+		Replacers: []Replacer{
+			// tokens and authorization codes in urls, e.g. reset links and oauth callbacks. The
+			// parameter name is kept so the url still reads.
+			{
+				Pattern: regexp.MustCompile(`(?i)[?&](?:token|code)=[^&#\s]+`),
+				Replace: func(match string) string {
+					name, _, _ := strings.Cut(match, "=")
+					return name + "=" + Redacted
+				},
+			},
+			// card numbers, optionally grouped with spaces or dashes. Only numbers with a valid
+			// checksum are redacted so ids, timestamps and phone numbers stay readable.
+			{
+				Pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+				Replace: func(match string) string {
+					if luhn(match) {
+						return Redacted
+					}
+					return match
+				},
+			},
+		},
+	}
+}
+
+// Scrub replaces every match of the Patterns and then runs the Replacers over s. Use it to redact
+// values shown outside of the logs, e.g. on the developer error page.
+func (c RedactConfig) Scrub(s string) string {
+	for _, p := range c.Patterns {
+		s = p.ReplaceAllString(s, Redacted)
+	}
+	for _, r := range c.Replacers {
+		s = r.Pattern.ReplaceAllStringFunc(s, r.Replace)
+	}
+	return s
+}
+
+// luhn reports whether the digits of s pass the Luhn checksum every card number carries
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return sum%10 == 0
+}
+
+// redactCore scrubs sensitive values from every entry before the wrapped core encodes it
+type redactCore struct {
+	zapcore.Core
+	keys    map[string]bool
+	headers map[string]bool
+	config  RedactConfig
+}
+
+// NewRedactCore wraps core so the keys, headers and patterns in config and every Secret field
+// are scrubbed before they reach the output
+func NewRedactCore(core zapcore.Core, config RedactConfig) zapcore.Core {
+	c := &redactCore{
+		Core:    core,
+		keys:    map[string]bool{},
+		headers: map[string]bool{},
+		config:  config,
+	}
+	for _, k := range config.Keys {
+		c.keys[strings.ToLower(k)] = true
+	}
+	for _, h := range config.Headers {
+		c.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	return c
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.Core = c.Core.With(c.redact(fields))
+	return &clone
+}
+
+func (c *redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.scrub(ent.Message)
+	return c.Core.Write(ent, c.redact(fields))
+}
+
+// redact returns a copy of the fields with the sensitive values replaced
+func (c *redactCore) redact(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, 0, len(fields))
+	for _, f := range fields {
+		out = append(out, c.redactField(f))
+	}
+	return out
+}
+
+func (c *redactCore) redactField(f zapcore.Field) zapcore.Field {
+	if f.Type == zapcore.NamespaceType || f.Type == zapcore.SkipType {
+		return f
+	}
+	if c.keys[strings.ToLower(f.Key)] {
+		return zap.String(f.Key, Redacted)
+	}
+
+	switch f.Type {
+	case zapcore.StringType:
+		f.String = c.scrub(f.String)
+	case zapcore.ErrorType:
+		// keep the error (and its verbose stack) unless something in it has to go
+		if err, ok := f.Interface.(error); ok {
+			if msg := c.scrub(err.Error()); msg != err.Error() {
+				return zap.String(f.Key, msg)
+			}
+		}
+	case zapcore.ArrayMarshalerType:
+		if m, ok := f.Interface.(messages); ok {
+			return zap.Array(f.Key, messages(c.scrubAll(m)))
+		}
+	case zapcore.ObjectMarshalerType:
+		if d, ok := f.Interface.(ErrorDetails); ok {
+			d.Message = c.scrub(d.Message)
+			d.Messages = c.scrubAll(d.Messages)
+			d.Stack = c.scrub(d.Stack)
+			return zap.Object(f.Key, d)
+		}
+	case zapcore.StringerType:
+		if _, ok := f.Interface.(secret); ok {
+			return zap.String(f.Key, Redacted)
+		}
+	case zapcore.ReflectType:
+		switch v := f.Interface.(type) {
+		case http.Header:
+			return zap.Any(f.Key, c.redactHeader(v))
+		case url.Values:
+			return zap.Any(f.Key, c.redactValues(v))
+		}
+	}
+	return f
+}
+
+func (c *redactCore) redactHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, vs := range h {
+		if c.headers[http.CanonicalHeaderKey(k)] || c.keys[strings.ToLower(k)] {
+			out[k] = []string{Redacted}
+			continue
+		}
+		out[k] = c.scrubAll(vs)
+	}
+	return out
+}
+
+func (c *redactCore) redactValues(values url.Values) url.Values {
+	out := make(url.Values, len(values))
+	for k, vs := range values {
+		if c.keys[strings.ToLower(k)] {
+			out[k] = []string{Redacted}
+			continue
+		}
+		out[k] = c.scrubAll(vs)
+	}
+	return out
+}
+
+func (c *redactCore) scrubAll(vs []string) []string {
+	out := make([]string, 0, len(vs))
+	for _, v := range vs {
+		out = append(out, c.scrub(v))
+	}
+	return out
+}
+
+func (c *redactCore) scrub(s string) string {
+	return c.config.Scrub(s)
+}
+
+// secret hides its value from every encoder, even without the redaction core. It doesn't hold on
+// to the value so nothing can print it by accident.
+type secret struct{}
+
+func (secret) String() string   { return Redacted }
+func (secret) GoString() string { return Redacted }
+
+// Secret marks a value as sensitive. The key is logged but the value never is, e.g.
+// logger.Info("login", log.Secret("password", form.Password)).
+func Secret(key string, value interface{}) zap.Field {
+	return zap.Stringer(key, secret{})
+}
@@ -0,0 +1,144 @@
+package log
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactCore(t *testing.T) {
+	type tc struct {
+		message       string
+		fields        []zap.Field
+		expectMessage string
+		expectFields  map[string]interface{}
+	}
+
+	tests := map[string]tc{
+		"redacts configured keys": {
+			message: "login",
+			fields: []zap.Field{
+				zap.String("Password", "hunter2"),
+				zap.Int("token", 1234),
+				zap.String("user", "bob"),
+			},
+			expectMessage: "login",
+			expectFields: map[string]interface{}{
+				"Password": Redacted,
+				"token":    Redacted,
+				"user":     "bob",
+			},
+		},
+		"scrubs patterns in messages and strings": {
+			message: "sent mail to bob@example.com",
+			fields: []zap.Field{
+				zap.String("card", "4111 1111 1111 1111"),
+				zap.String("auth", "Bearer abc.def-123"),
+				zap.String("jwt", "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig"),
+			},
+			expectMessage: "sent mail to " + Redacted,
+			expectFields: map[string]interface{}{
+				"card": Redacted,
+				"auth": Redacted,
+				"jwt":  Redacted,
+			},
+		},
+		"only scrubs numbers with a card checksum": {
+			message:       "charged 4111-1111-1111-1111 for order 1234567890123456",
+			expectMessage: "charged " + Redacted + " for order 1234567890123456",
+			expectFields:  map[string]interface{}{},
+		},
+		"scrubs tokens and codes in urls": {
+			message: "GET /reset-password?token=abc123&next=/home",
+			fields: []zap.Field{
+				zap.String("callback", "https://example.com/auth/corp/callback?state=xyz&code=4/0Adeu5&scope=email"),
+			},
+			expectMessage: "GET /reset-password?token=" + Redacted + "&next=/home",
+			expectFields: map[string]interface{}{
+				"callback": "https://example.com/auth/corp/callback?state=xyz&code=" + Redacted + "&scope=email",
+			},
+		},
+		"scrubs errors": {
+			message: "failed",
+			fields: []zap.Field{
+				zap.Error(errors.New("no user bob@example.com")),
+			},
+			expectMessage: "failed",
+			expectFields: map[string]interface{}{
+				"error": "no user " + Redacted,
+			},
+		},
+		"redacts headers": {
+			message: "request",
+			fields: []zap.Field{
+				zap.Any("headers", http.Header{
+					"Authorization": {"Basic Ym9iOmh1bnRlcjI="},
+					"Cookie":        {"session=abc"},
+					"Accept":        {"text/html"},
+				}),
+			},
+			expectMessage: "request",
+			expectFields: map[string]interface{}{
+				"headers": http.Header{
+					"Authorization": {Redacted},
+					"Cookie":        {Redacted},
+					"Accept":        {"text/html"},
+				},
+			},
+		},
+		"redacts form values": {
+			message: "form",
+			fields: []zap.Field{
+				zap.Any("form", url.Values{"password": {"hunter2"}, "name": {"bob"}}),
+			},
+			expectMessage: "form",
+			expectFields: map[string]interface{}{
+				"form": url.Values{"password": {Redacted}, "name": {"bob"}},
+			},
+		},
+		"redacts secrets": {
+			message: "created key",
+			fields: []zap.Field{
+				Secret("key", "sk_live_123"),
+			},
+			expectMessage: "created key",
+			expectFields: map[string]interface{}{
+				"key": Redacted,
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			core, logs := observer.New(zap.DebugLevel)
+			logger := zap.New(NewRedactCore(core, DefaultRedactConfig()))
+
+			// fields added with With are scrubbed too
+			logger.With(tc.fields...).Info(tc.message)
+			logger.Info(tc.message, tc.fields...)
+
+			entries := logs.All()
+			require.Len(t, entries, 2)
+			for _, entry := range entries {
+				assert.Equal(t, tc.expectMessage, entry.Message)
+				assert.Equal(t, tc.expectFields, entry.ContextMap())
+			}
+		})
+	}
+}
+
+func TestSecret(t *testing.T) {
+	// secrets stay hidden even without the redaction core
+	core, logs := observer.New(zap.DebugLevel)
+	zap.New(core).Info("created key", Secret("key", "sk_live_123"))
+
+	assert.Equal(t, Redacted, logs.All()[0].ContextMap()["key"])
+	assert.NotContains(t, fmt.Sprintf("%v %#v", Secret("key", "sk_live_123"), Secret("key", "sk_live_123")), "sk_live_123")
+}
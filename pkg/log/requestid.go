@@ -0,0 +1,63 @@
+package log
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader is the header used to pass the request id between services and back to the client
+const RequestIDHeader = echo.HeaderXRequestID
+
+// maxRequestIDLength bounds the ids we accept from clients so they can't bloat every log line
+const maxRequestIDLength = 128
+
+const requestIDKey = contextKey("request-id")
+
+// RequestIDFromContext returns the id of the request the context belongs to
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Middleware honors the X-Request-ID of the incoming request (or generates one), echoes it in
+// the response, and stores a child logger carrying the request id, method and route in the
+// request context. Get it with FromContext.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+
+			id := req.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = uuid.NewString()
+			}
+			c.Response().Header().Set(RequestIDHeader, id)
+
+			ctx := context.WithValue(req.Context(), requestIDKey, id)
+			ctx = NewContext(ctx, FromContext(ctx).With(
+				zap.String("request_id", id),
+				zap.String("method", req.Method),
+				zap.String("route", c.Path()),
+			))
+			c.SetRequest(req.WithContext(ctx))
+
+			return next(c)
+		}
+	}
+}
+
+// validRequestID only accepts short printable ascii ids so clients can't inject anything odd into our logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package log
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	type tc struct {
+		incoming   string
+		expectSame bool
+	}
+
+	tests := map[string]tc{
+		"honors incoming id": {
+			incoming:   "abc-123",
+			expectSame: true,
+		},
+		"generates missing id": {},
+		"replaces id with control characters": {
+			incoming: "abc\n123",
+		},
+		"replaces id that is too long": {
+			incoming: strings.Repeat("a", maxRequestIDLength+1),
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			core, logs := observer.New(zap.DebugLevel)
+			restore := zap.ReplaceGlobals(zap.New(core))
+			defer restore()
+
+			e := echo.New()
+			e.Use(Middleware())
+			var ctxID string
+			e.GET("/users/:id", func(c echo.Context) error {
+				ctxID = RequestIDFromContext(c.Request().Context())
+				FromContext(c.Request().Context()).Info("handled")
+				return c.NoContent(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+			req.Header.Set(RequestIDHeader, tc.incoming)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(RequestIDHeader)
+			assert.NotEmpty(t, id)
+			assert.Equal(t, tc.expectSame, id == tc.incoming)
+			assert.Equal(t, id, ctxID)
+
+			fields := logs.FilterMessage("handled").All()[0].ContextMap()
+			assert.Equal(t, id, fields["request_id"])
+			assert.Equal(t, "/users/:id", fields["route"])
+			assert.Equal(t, http.MethodGet, fields["method"])
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registry holds every metric for the process. We use our own registry rather than the prometheus
+// default so nothing registered by third party packages shows up unexpectedly.
+var registry = prometheus.NewRegistry()
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Count of http requests by route template, method and status.",
+	}, []string{"route", "method", "status"})
+
+	latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of http requests by route template, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	responseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_response_size_bytes",
+		Help:    "Size of http response bodies by route template, method and status.",
+		Buckets: prometheus.ExponentialBuckets(128, 4, 8),
+	}, []string{"route", "method", "status"})
+
+	inFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Number of http requests currently being served by route template and method.",
+	}, []string{"route", "method"})
+
+	renders = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "templ_render_duration_seconds",
+		Help:    "Time spent rendering templ components by route template.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"route"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requests,
+		latency,
+		responseSize,
+		inFlight,
+		renders,
+	)
+}
+
+// Handler serves every registered metric in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records request metrics keyed by the echo route template (c.Path()) rather than
+// the raw uri so the label cardinality stays bounded.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			route := c.Path()
+			method := c.Request().Method
+
+			inFlight.WithLabelValues(route, method).Inc()
+			defer inFlight.WithLabelValues(route, method).Dec()
+
+			start := time.Now()
+			defer func() {
+				if r := recover(); r != nil {
+					// aborted responses, e.g. with http.ErrAbortHandler, count with the status that was sent
+					observe(c, route, method, c.Response().Status, start)
+					panic(r)
+				}
+			}()
+
+			err := next(c)
+			code := c.Response().Status
+			if err != nil && !c.Response().Committed {
+				// the error handler responds once the error is returned to echo, record the status it sends
+				code = apperr.HTTPStatus(err)
+			}
+			observe(c, route, method, code, start)
+			return err
+		}
+	}
+}
+
+// observe records a finished request
+func observe(c echo.Context, route, method string, code int, start time.Time) {
+	status := strconv.Itoa(code)
+	requests.WithLabelValues(route, method, status).Inc()
+	latency.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+	responseSize.WithLabelValues(route, method, status).Observe(float64(c.Response().Size))
+}
+
+// ObserveRender records how long rendering the templ component for a route took since start.
+// We label by route rather than component because generated templ components are anonymous
+// closures that can't be named reliably.
+func ObserveRender(route string, start time.Time) {
+	renders.WithLabelValues(route).Observe(time.Since(start).Seconds())
+}
+
+// NewCounter registers a counter for handlers to record their own events. Registering the same
+// counter again (e.g. a handler constructed twice) returns the existing one. It panics if the
+// name is already used by a metric of a different shape, like prometheus.MustRegister.
+func NewCounter(name, help string, labels ...string) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	err := registry.Register(counter)
+	if err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			panic(err)
+		}
+		return are.ExistingCollector.(*prometheus.CounterVec)
+	}
+	return counter
+}
+
+// Registerer gives access to the registry for metric types not covered by NewCounter
+func Registerer() prometheus.Registerer {
+	return registry
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	var handled error
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		handled = err
+		e.DefaultHTTPErrorHandler(err, c)
+	}
+	e.Use(Middleware())
+	e.GET("/users/:id", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.ErrForbidden
+	})
+	e.GET("/missing", func(c echo.Context) error {
+		return apperr.New(apperr.CodeNotFound, "There is no such user")
+	})
+	e.GET("/abort", func(c echo.Context) error {
+		_ = c.String(http.StatusOK, "half")
+		panic(http.ErrAbortHandler)
+	})
+
+	type tc struct {
+		path        string
+		route       string
+		status      string
+		expectErr   bool
+		expectAbort bool
+	}
+
+	tests := map[string]tc{
+		"labels by route template": {
+			path:   "/users/123",
+			route:  "/users/:id",
+			status: "200",
+		},
+		"records the status of echo errors": {
+			path:      "/fail",
+			route:     "/fail",
+			status:    "403",
+			expectErr: true,
+		},
+		"records the status of app errors": {
+			path:      "/missing",
+			route:     "/missing",
+			status:    "404",
+			expectErr: true,
+		},
+		"records aborted responses": {
+			path:        "/abort",
+			route:       "/abort",
+			status:      "200",
+			expectAbort: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			handled = nil
+			before := testutil.ToFloat64(requests.WithLabelValues(tc.route, http.MethodGet, tc.status))
+			serve := func() {
+				e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+			}
+			if tc.expectAbort {
+				assert.PanicsWithValue(t, http.ErrAbortHandler, serve)
+			} else {
+				serve()
+			}
+			after := testutil.ToFloat64(requests.WithLabelValues(tc.route, http.MethodGet, tc.status))
+			assert.Equal(t, before+1, after)
+			// the error is left to the error handler
+			assert.Equal(t, tc.expectErr, handled != nil)
+			assert.Equal(t, float64(0), testutil.ToFloat64(inFlight.WithLabelValues(tc.route, http.MethodGet)))
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager builds an autocert manager that requests certificates for the configured domains
+// from the configured directory. It answers both HTTP-01 (through HTTPHandler) and TLS-ALPN-01
+// (through TLSConfig) challenges.
+func newACMEManager(config ServerConfig) (m *autocert.Manager, err error) {
+	if len(config.ACMEDomains) == 0 {
+		return m, errors.New("ACME_DOMAINS is required when ACME is enabled")
+	}
+
+	client := &acme.Client{DirectoryURL: config.ACMEDirectoryURL}
+	if config.ACMECARoots != "" {
+		rootsPEM, err := os.ReadFile(config.ACMECARoots)
+		if err != nil {
+			return m, errors.Wrap(err, "reading acme ca roots")
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(rootsPEM) {
+			return m, errors.Errorf("no certificates found in %s", config.ACMECARoots)
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomains...),
+		Email:      config.ACMEEmail,
+		Client:     client,
+	}, nil
+}
+
+// redirectHandler redirects plain http requests to the https listener on httpsPort
+func redirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "use https", http.StatusBadRequest)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/lifecycle"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acmeTestDomain must have more than one label for autocert to accept it. pebble-challtestsrv
+// resolves every name to 127.0.0.1 by default.
+const acmeTestDomain = "gothem-stack.test"
+
+// TestACMEWithPebble runs the ACME flow end to end against a local Pebble server
+// (https://github.com/letsencrypt/pebble). From a pebble checkout run
+//
+//	pebble-challtestsrv -http01 "" -https01 "" -tlsalpn01 "" -doh ""
+//	PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//	PEBBLE_DIRECTORY_URL=https://localhost:14000/dir PEBBLE_CA_ROOTS=<pebble>/test/certs/pebble.minica.pem go test ./pkg/server -run ACME
+//
+// Pebble validates challenges against port 5002 (HTTP-01) and 5001 (TLS-ALPN-01) so the test
+// listens on those.
+func TestACMEWithPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL is not set")
+	}
+	require.NotEmpty(t, os.Getenv("PEBBLE_CA_ROOTS"), "PEBBLE_CA_ROOTS must point at pebble's minica root")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := newServer(ctx, ServerConfig{
+		Port:             5001,
+		HTTPRedirectPort: 5002,
+		ACME:             true,
+		ACMEDomains:      []string{acmeTestDomain},
+		ACMEDirectoryURL: directory,
+		ACMECacheDir:     t.TempDir(),
+		ACMECARoots:      os.Getenv("PEBBLE_CA_ROOTS"),
+		ShutdownTimeout:  time.Second,
+	})
+	require.NoError(t, err)
+	s.acme.Client.HTTPClient.Transport = pebbleTransport{s.acme.Client.HTTPClient.Transport}
+
+	lc := lifecycle.New()
+	s.Register(lc)
+	done := make(chan error, 1)
+	go func() {
+		done <- lc.Run(ctx)
+	}()
+
+	// pebble issues from a root generated at startup so we only check who issued the certificate
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				_, port, _ := net.SplitHostPort(addr)
+				return dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = client.Get("https://" + acmeTestDomain + ":5001/healthz")
+		return err == nil
+	}, 30*time.Second, 100*time.Millisecond)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEmpty(t, resp.TLS.PeerCertificates)
+	assert.Contains(t, resp.TLS.PeerCertificates[0].Issuer.CommonName, "Pebble")
+
+	resp, err = client.Get("http://" + acmeTestDomain + ":5002/healthz?probe=1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://"+acmeTestDomain+":5001/healthz?probe=1", resp.Header.Get("Location"))
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+// pebbleTransport works around pebble leaving the Location header off finalize responses. The
+// x/crypto acme client needs it to poll the order while it is processing. Boulder (Let's Encrypt)
+// always sets it.
+type pebbleTransport struct {
+	http.RoundTripper
+}
+
+func (t pebbleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil && strings.Contains(req.URL.Path, "/finalize-order/") && resp.Header.Get("Location") == "" {
+		resp.Header.Set("Location", strings.Replace(req.URL.String(), "/finalize-order/", "/my-order/", 1))
+	}
+	return resp, err
+}
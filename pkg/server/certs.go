@@ -1,126 +1,406 @@
 package server
 
 import (
-	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
 const (
-	privateKeyFile = "./server.key"
-	publicKeyFile  = "./server.crt"
+	caCertFile   = "rootCA.pem"
+	caKeyFile    = "rootCA-key.pem"
+	leafCertFile = "server.crt"
+	leafKeyFile  = "server.key"
+
+	caValidity = 10 * 365 * 24 * time.Hour
+	// leaf certificates are short lived and regenerated once they get within leafRenewBefore of expiring
+	leafValidity    = 90 * 24 * time.Hour
+	leafRenewBefore = 30 * 24 * time.Hour
+
+	// reloadInterval is how often we look at the certificate files on disk for changes
+	reloadInterval = 10 * time.Second
 )
 
-func hasCerts() bool {
-	_, privErr := os.Stat(privateKeyFile)
-	_, pubErr := os.Stat(publicKeyFile)
+// defaultCertHosts are always included in locally issued certificates
+var defaultCertHosts = []string{"localhost", "127.0.0.1", "::1"}
 
-	return privErr == nil && pubErr == nil
+// localCA is a mkcert style certificate authority used to sign leaf certificates for local
+// development. Trust rootCA.pem in your browser or OS keychain to avoid certificate warnings.
+type localCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
 }
 
-func generateCerts() (*rsa.PrivateKey, error) {
-	bitSize := 4096
+// loadOrCreateCA loads the CA from dir, creating a new one if it does not exist yet
+func loadOrCreateCA(dir string) (ca *localCA, err error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	if !fileExists(certPath) || !fileExists(keyPath) {
+		err = createCA(certPath, keyPath)
+		if err != nil {
+			return ca, err
+		}
+		zap.S().Infof("created local development CA at %s. Trust it to avoid browser certificate warnings", certPath)
+	}
 
-	privateKey, err := generatePrivateKey(bitSize)
+	cert, err := readCertificate(certPath)
 	if err != nil {
-		return nil, err
+		return ca, err
 	}
 
-	publicKeyBytes, err := generateX509Cert(privateKey)
+	keyPEM, err := os.ReadFile(keyPath)
 	if err != nil {
-		return nil, err
+		return ca, errors.Wrap(err, "reading ca key")
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return ca, errors.Errorf("no pem data found in %s", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return ca, errors.Wrap(err, "parsing ca key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return ca, errors.Errorf("ca key in %s cannot sign certificates", keyPath)
 	}
 
-	privateKeyBytes := encodePrivateKeyToPEM(privateKey)
+	return &localCA{cert: cert, key: signer}, nil
+}
 
-	err = writeKeyToFile(privateKeyBytes, privateKeyFile)
+func createCA(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return nil, err
+		return errors.Wrap(err, "generating ca key")
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"gothem-stack development CA"},
+			CommonName:   "gothem-stack local CA " + hostname,
+		},
+		SubjectKeyId: subjectKeyID(&key.PublicKey),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(caValidity),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return errors.Wrap(err, "creating ca certificate")
+	}
+
+	return writeKeyPair(certPath, keyPath, certDER, key)
+}
+
+// issue signs a new ECDSA leaf certificate for the hosts and writes it to certPath and keyPath
+func (ca *localCA) issue(certPath, keyPath string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "generating leaf key")
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"gothem-stack development certificate"},
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(leafValidity),
+
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return errors.Wrap(err, "creating leaf certificate")
+	}
+
+	return writeKeyPair(certPath, keyPath, certDER, key)
+}
+
+// certLoader serves a certificate through tls.Config.GetCertificate and reloads it when the
+// files change on disk so rotated certificates take effect without a restart
+type certLoader struct {
+	certFile string
+	keyFile  string
+
+	// issue regenerates the certificate files. It is nil for certificates managed outside the process.
+	issue func() error
+	hosts []string
+	now   func() time.Time
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// newFileCertLoader serves an externally managed certificate
+func newFileCertLoader(certFile, keyFile string) (l *certLoader, err error) {
+	l = &certLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		now:      time.Now,
+	}
+	return l, l.load()
+}
+
+// newLocalCertLoader serves a leaf certificate signed by the local development CA in dir, or in
+// the user cache dir if dir is empty. The leaf is valid for localhost and the extra hosts and is
+// regenerated when it is close to expiry.
+func newLocalCertLoader(dir string, hosts []string) (l *certLoader, err error) {
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return l, errors.Wrap(err, "finding cert directory, set CERT_DIR")
+		}
+		dir = filepath.Join(cache, "gothem-stack", "certs")
+	}
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return l, errors.Wrap(err, "creating cert directory")
+	}
+
+	ca, err := loadOrCreateCA(dir)
+	if err != nil {
+		return l, err
+	}
+
+	l = &certLoader{
+		certFile: filepath.Join(dir, leafCertFile),
+		keyFile:  filepath.Join(dir, leafKeyFile),
+		hosts:    append(append([]string{}, defaultCertHosts...), hosts...),
+		now:      time.Now,
+	}
+	l.issue = func() error {
+		zap.S().Infof("issuing local certificate for %v", l.hosts)
+		return ca.issue(l.certFile, l.keyFile, l.hosts)
+	}
+	return l, l.load()
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If a reload fails we keep serving the
+// previous certificate rather than failing every handshake.
+func (l *certLoader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if l.cert != nil && now.Sub(l.checked) < reloadInterval {
+		return l.cert, nil
 	}
+	l.checked = now
 
-	err = writeKeyToFile([]byte(publicKeyBytes), publicKeyFile)
+	err := l.refresh(now)
 	if err != nil {
+		if l.cert != nil {
+			zap.S().Errorf("reloading tls certificate: %v", err)
+			return l.cert, nil
+		}
 		return nil, err
 	}
+	return l.cert, nil
+}
 
-	return privateKey, nil
+// load does the initial load so configuration errors surface at startup
+func (l *certLoader) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.checked = l.now()
+	return l.refresh(l.checked)
 }
 
-// generatePrivateKey creates a RSA Private Key of specified byte size
-func generatePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
-	// Private Key generation
-	privateKey, err := rsa.GenerateKey(rand.Reader, bitSize)
+// refresh regenerates the certificate if we own it and it needs it, then reloads the files if
+// they changed since we last read them. The caller must hold l.mu.
+func (l *certLoader) refresh(now time.Time) error {
+	if l.issue != nil && l.needsIssue(now) {
+		err := l.issue()
+		if err != nil {
+			return err
+		}
+	}
+
+	modTime, err := latestModTime(l.certFile, l.keyFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "generating private key")
+		return err
+	}
+	if l.cert != nil && modTime.Equal(l.modTime) {
+		return nil
 	}
 
-	// Validate Private Key
-	err = privateKey.Validate()
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "validating private key")
+		return errors.Wrap(err, "loading tls key pair")
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "parsing tls certificate")
 	}
 
-	return privateKey, nil
+	zap.S().Infof("loaded tls certificate %s valid until %s", l.certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	l.cert = &cert
+	l.modTime = modTime
+	return nil
 }
 
-// encodePrivateKeyToPEM encodes Private Key from RSA to PEM format
-func encodePrivateKeyToPEM(privateKey *rsa.PrivateKey) []byte {
-	// pem.Block
-	privBlock := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+// needsIssue reports whether the certificate on disk is missing, close to expiry, or does not
+// cover all the configured hosts
+func (l *certLoader) needsIssue(now time.Time) bool {
+	if !fileExists(l.keyFile) {
+		return true
 	}
 
-	// Private key in PEM format
-	privatePEM := pem.EncodeToMemory(&privBlock)
+	leaf, err := readCertificate(l.certFile)
+	if err != nil {
+		return true
+	}
+
+	if now.Add(leafRenewBefore).After(leaf.NotAfter) {
+		return true
+	}
 
-	return privatePEM
+	for _, h := range l.hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return true
+		}
+	}
+	return false
 }
 
-// generateX509Cert take a rsa.PublicKey and return bytes suitable for writing to .pub file
-// returns in the format "ssh-rsa ..."
-func generateX509Cert(privateKey *rsa.PrivateKey) (b []byte, err error) {
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"ACME corp"},
-		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(time.Hour * 24 * 180),
+func readCertificate(path string) (cert *x509.Certificate, err error) {
+	certPEM, err := os.ReadFile(path)
+	if err != nil {
+		return cert, errors.Wrap(err, "reading certificate")
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return cert, errors.Errorf("no certificate found in %s", path)
+	}
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return cert, errors.Wrap(err, "parsing certificate")
+	}
+	return cert, nil
+}
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
+func writeKeyPair(certPath, keyPath string, certDER []byte, key crypto.Signer) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "marshalling private key")
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	// write both files before moving either in place, so a crash or a reload never sees a half
+	// written file and the pair is swapped as close together as possible
+	keyTmp, err := writeKeyToFile(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), keyPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyTmp)
+	certTmp, err := writeKeyToFile(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), certPath)
 	if err != nil {
-		return b, errors.Wrap(err, "creating x509 certificate")
+		return err
 	}
+	defer os.Remove(certTmp)
 
-	out := &bytes.Buffer{}
-	err = pem.Encode(out, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	err = os.Rename(keyTmp, keyPath)
 	if err != nil {
-		return b, errors.Wrap(err, "encoding certificate to pem")
+		return errors.Wrap(err, "replacing key file")
 	}
+	err = os.Rename(certTmp, certPath)
+	return errors.Wrap(err, "replacing certificate file")
+}
 
-	return out.Bytes(), nil
+// writeKeyToFile writes keys to a temporary file next to saveFileTo for the caller to rename into
+// place. Only the owner can read it.
+func writeKeyToFile(keyBytes []byte, saveFileTo string) (tmp string, err error) {
+	f, err := os.CreateTemp(filepath.Dir(saveFileTo), "."+filepath.Base(saveFileTo)+".*")
+	if err != nil {
+		return tmp, errors.Wrap(err, "creating temporary key file")
+	}
+	_, err = f.Write(keyBytes)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return tmp, errors.Wrap(err, "writing key to file")
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return tmp, errors.Wrap(err, "writing key to file")
+	}
+	return f.Name(), nil
+}
+
+func latestModTime(paths ...string) (t time.Time, err error) {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return t, errors.Wrap(err, "checking certificate file")
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
 
-// writePemToFile writes keys to a file
-func writeKeyToFile(keyBytes []byte, saveFileTo string) error {
-	err := os.WriteFile(saveFileTo, keyBytes, 0o600)
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return errors.Wrap(err, "writing key to file")
+		return nil, errors.Wrap(err, "generating serial number")
 	}
+	return serial, nil
+}
 
-	return nil
+// subjectKeyID follows the RFC 5280 method of hashing the public key
+func subjectKeyID(pub *ecdsa.PublicKey) []byte {
+	b, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha1.Sum(b)
+	return sum[:]
 }
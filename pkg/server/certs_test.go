@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalCertLoader(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := newLocalCertLoader(dir, []string{"app.test"})
+	require.NoError(t, err)
+
+	cert, err := l.GetCertificate(nil)
+	require.NoError(t, err)
+
+	ca, err := readCertificate(filepath.Join(dir, caCertFile))
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "app.test"} {
+		_, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		assert.NoError(t, err, host)
+	}
+	assert.Error(t, cert.Leaf.VerifyHostname("other.test"))
+}
+
+func TestLocalCertLoaderRenews(t *testing.T) {
+	type tc struct {
+		now           time.Duration
+		hosts         []string
+		expectRenewal bool
+	}
+
+	tests := map[string]tc{
+		"fresh certificate": {
+			now: reloadInterval,
+		},
+		"close to expiry": {
+			now:           leafValidity - leafRenewBefore + time.Hour,
+			expectRenewal: true,
+		},
+		"new host configured": {
+			now:           reloadInterval,
+			hosts:         []string{"new.test"},
+			expectRenewal: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			first, err := newLocalCertLoader(dir, nil)
+			require.NoError(t, err)
+			original, err := first.GetCertificate(nil)
+			require.NoError(t, err)
+
+			l, err := newLocalCertLoader(dir, tc.hosts)
+			require.NoError(t, err)
+			start := time.Now()
+			l.now = func() time.Time { return start.Add(tc.now) }
+
+			cert, err := l.GetCertificate(nil)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectRenewal, original.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0)
+
+			// the files are swapped in place without leaving temporary files behind
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 4)
+		})
+	}
+}
+
+func TestFileCertLoaderReloadsRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := loadOrCreateCA(dir)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	require.NoError(t, ca.issue(certFile, keyFile, []string{"one.test"}))
+
+	l, err := newFileCertLoader(certFile, keyFile)
+	require.NoError(t, err)
+	start := time.Now()
+	l.now = func() time.Time { return start }
+
+	cert, err := l.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("one.test"))
+
+	// rotate the files on disk and make sure the modification time moves forward
+	require.NoError(t, ca.issue(certFile, keyFile, []string{"two.test"}))
+	later := start.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	// within the reload interval we keep serving the cached certificate
+	cert, err = l.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("one.test"))
+
+	l.now = func() time.Time { return start.Add(reloadInterval) }
+	cert, err = l.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.NoError(t, cert.Leaf.VerifyHostname("two.test"))
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/pkg/errors"
+)
+
+// newJWTAuthenticator verifies the JWT bearer tokens of the configured issuer. It returns nil if
+// JWT_ISSUER isn't set.
+func newJWTAuthenticator(config ServerConfig) (auth.Authenticator, error) {
+	if config.JWTIssuer == "" {
+		return nil, nil
+	}
+
+	var keys *auth.KeySet
+	switch {
+	case config.JWTJWKSURL != "" && config.JWTKeysFile != "":
+		return nil, errors.New("set only one of JWT_JWKS_URL and JWT_KEYS_FILE")
+	case config.JWTJWKSURL != "":
+		keys = auth.NewKeySet(config.JWTJWKSURL, &http.Client{Timeout: 10 * time.Second})
+	case config.JWTKeysFile != "":
+		data, err := os.ReadFile(config.JWTKeysFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading jwt keys | file=[%s]", config.JWTKeysFile)
+		}
+		keys, err = auth.ParseKeySet(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing jwt keys | file=[%s]", config.JWTKeysFile)
+		}
+	default:
+		return nil, errors.New("JWT_ISSUER needs JWT_JWKS_URL or JWT_KEYS_FILE")
+	}
+
+	return auth.JWT(auth.JWTConfig{
+		Issuer:     config.JWTIssuer,
+		Audience:   config.JWTAudience,
+		Keys:       keys,
+		Algorithms: config.JWTAlgorithms,
+		RolesClaim: config.JWTRolesClaim,
+		Roles:      config.JWTRoles,
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
+)
+
+// oidcProviderConfig is the config of a single provider in OIDC_PROVIDERS. It is parsed from the
+// env with the prefix OIDC_<NAME>, e.g. OIDC_CORP_ISSUER.
+type oidcProviderConfig struct {
+	// the keys come from the field names rather than envconfig tags, which envconfig would also
+	// look up without the prefix
+	DisplayName  string   `split_words:"true"`
+	Issuer       string   `required:"true"`
+	ClientID     string   `split_words:"true" required:"true"`
+	ClientSecret string   `split_words:"true"`
+	Scopes       []string `default:"email,profile"`
+	// RolesClaim is the claim with the groups of the user. Roles maps its values to our roles,
+	// e.g. platform-admins:admin.
+	RolesClaim string `split_words:"true"`
+	Roles      map[string]string
+}
+
+// loadOIDCProviders parses the config of every provider in OIDC_PROVIDERS from the env. Their
+// callbacks are under the base url.
+func loadOIDCProviders(names []string, baseURL string) (providers []auth.OIDCProvider, err error) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+
+		var c oidcProviderConfig
+		err = envconfig.Process(prefix, &c)
+		if err != nil {
+			return providers, errors.Wrapf(err, "loading oidc provider | provider=[%s]", name)
+		}
+		providers = append(providers, auth.OIDCProvider{
+			Name:         name,
+			DisplayName:  c.DisplayName,
+			Issuer:       c.Issuer,
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			RedirectURL:  baseURL + "/auth/" + name + "/callback",
+			Scopes:       c.Scopes,
+			RolesClaim:   c.RolesClaim,
+			Roles:        c.Roles,
+		})
+	}
+	return providers, nil
+}
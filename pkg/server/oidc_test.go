@@ -0,0 +1,78 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOIDCProviders(t *testing.T) {
+	type tc struct {
+		env       map[string]string
+		names     []string
+		expect    []auth.OIDCProvider
+		expectErr bool
+	}
+
+	tests := map[string]tc{
+		"no providers": {},
+		"providers are configured by name": {
+			env: map[string]string{
+				"OIDC_CORP_ISSUER":         "https://idp.example.com",
+				"OIDC_CORP_CLIENT_ID":      "app",
+				"OIDC_CORP_CLIENT_SECRET":  "secret",
+				"OIDC_CORP_DISPLAY_NAME":   "Corp SSO",
+				"OIDC_CORP_ROLES_CLAIM":    "groups",
+				"OIDC_CORP_ROLES":          "platform-admins:admin",
+				"OIDC_GOOGLE_WS_ISSUER":    "https://accounts.google.com",
+				"OIDC_GOOGLE_WS_CLIENT_ID": "google-app",
+				"OIDC_GOOGLE_WS_SCOPES":    "email",
+			},
+			names: []string{"corp", "google-ws"},
+			expect: []auth.OIDCProvider{
+				{
+					Name:         "corp",
+					DisplayName:  "Corp SSO",
+					Issuer:       "https://idp.example.com",
+					ClientID:     "app",
+					ClientSecret: "secret",
+					RedirectURL:  "https://app.example.com/auth/corp/callback",
+					Scopes:       []string{"email", "profile"},
+					RolesClaim:   "groups",
+					Roles:        map[string]string{"platform-admins": "admin"},
+				},
+				{
+					Name:        "google-ws",
+					Issuer:      "https://accounts.google.com",
+					ClientID:    "google-app",
+					RedirectURL: "https://app.example.com/auth/google-ws/callback",
+					Scopes:      []string{"email"},
+				},
+			},
+		},
+		"missing issuer": {
+			env:       map[string]string{"OIDC_CORP_CLIENT_ID": "app", "ISSUER": "https://idp.example.com"},
+			names:     []string{"corp"},
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			providers, err := loadOIDCProviders(tc.names, "https://app.example.com/")
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, providers)
+		})
+	}
+}
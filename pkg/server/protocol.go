@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/grindlemire/gothem-stack/pkg/lifecycle"
+
+	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// protocolH1 only serves HTTP/1.1, even over tls
+	protocolH1 = "h1"
+	// protocolH2C serves HTTP/2 without tls (prior knowledge or upgrade) as well as HTTP/1.1.
+	// This is what Cloud Run uses when end to end HTTP/2 is enabled.
+	protocolH2C = "h2c"
+	// protocolH2 serves HTTP/2 over tls negotiated with ALPN as well as HTTP/1.1
+	protocolH2 = "h2"
+)
+
+// configureProtocol sets srv up for the configured protocol and wraps its handler as needed. It
+// returns an HTTP/3 server sharing the same handler if HTTP3 is enabled.
+func configureProtocol(config ServerConfig, srv *http.Server) (h3 *http3.Server, err error) {
+	protocol := strings.ToLower(config.Protocol)
+	if protocol == "" {
+		protocol = protocolH1
+		if srv.TLSConfig != nil {
+			protocol = protocolH2
+		}
+	}
+
+	switch protocol {
+	case protocolH1:
+		// a non nil empty map turns off the automatic HTTP/2 support for tls
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		if srv.TLSConfig != nil {
+			// tls configs that come with their own protocols, e.g. the acme one, offer h2 which
+			// clients would then pick and get HTTP/1.1 back
+			srv.TLSConfig = srv.TLSConfig.Clone()
+			srv.TLSConfig.NextProtos = slices.DeleteFunc(srv.TLSConfig.NextProtos, func(proto string) bool {
+				return proto == http2.NextProtoTLS
+			})
+		}
+	case protocolH2C:
+		if srv.TLSConfig != nil {
+			return h3, errors.New("PROTOCOL=h2c is cleartext and can't be used with tls, use h2 instead")
+		}
+		// configuring the http2 server against srv registers it for graceful shutdown so the
+		// hijacked h2c connections are drained along with everything else. ConfigureServer also
+		// sets up tls which we have to undo since we are serving cleartext.
+		h2s := &http2.Server{}
+		err = http2.ConfigureServer(srv, h2s)
+		if err != nil {
+			return h3, errors.Wrap(err, "configuring http2")
+		}
+		srv.TLSConfig = nil
+		srv.TLSNextProto = nil
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	case protocolH2:
+		if srv.TLSConfig == nil {
+			return h3, errors.New("PROTOCOL=h2 requires tls, use h2c for cleartext HTTP/2")
+		}
+	default:
+		return h3, errors.Errorf("unknown protocol %q", config.Protocol)
+	}
+
+	if !config.HTTP3 {
+		return nil, nil
+	}
+	if srv.TLSConfig == nil {
+		return h3, errors.New("HTTP3 requires tls")
+	}
+
+	h3 = &http3.Server{
+		Addr:      srv.Addr,
+		Port:      config.Port,
+		Handler:   srv.Handler,
+		TLSConfig: srv.TLSConfig,
+		// 0-RTT requests can be replayed so we don't accept them
+		QUICConfig: &quic.Config{},
+	}
+	srv.Handler = altSvcHandler(h3, srv.Handler)
+	return h3, nil
+}
+
+// altSvcHandler advertises the HTTP/3 listener to clients connecting over tcp
+func altSvcHandler(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// this only fails before the quic listener is up, in which case there is nothing to advertise
+		_ = h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveHTTP3 binds the udp socket so address errors surface immediately and then serves in the background
+func serveHTTP3(lc *lifecycle.Manager, name string, h3 *http3.Server) error {
+	conn, err := net.ListenPacket("udp", h3.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "listening on udp %s", h3.Addr)
+	}
+
+	go func() {
+		// closing the server doesn't close a socket it was given
+		defer conn.Close()
+		zap.S().Infof("%s started listening on udp %s", name, h3.Addr)
+		err := h3.Serve(conn)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) {
+			lc.Fail(name, errors.Wrap(err, "serving http3"))
+		}
+	}()
+	return nil
+}
+
+// shutdownHTTP3 gracefully closes the HTTP/3 server if there is one
+func shutdownHTTP3(ctx context.Context, h3 *http3.Server) error {
+	if h3 == nil {
+		return nil
+	}
+	return errors.Wrap(h3.Shutdown(ctx), "shutting down http3 server")
+}
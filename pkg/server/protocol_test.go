@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/lifecycle"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestProtocols(t *testing.T) {
+	type tc struct {
+		config        ServerConfig
+		client        func(t *testing.T, dir string) *http.Client
+		scheme        string
+		expectedProto string
+		expectAltSvc  bool
+	}
+
+	tests := map[string]tc{
+		"h1": {
+			config:        ServerConfig{Protocol: protocolH1},
+			client:        func(t *testing.T, dir string) *http.Client { return &http.Client{} },
+			scheme:        "http",
+			expectedProto: "HTTP/1.1",
+		},
+		"h2c": {
+			config: ServerConfig{Protocol: protocolH2C},
+			client: func(t *testing.T, dir string) *http.Client {
+				return &http.Client{Transport: &http2.Transport{
+					AllowHTTP: true,
+					DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, network, addr)
+					},
+				}}
+			},
+			scheme:        "http",
+			expectedProto: "HTTP/2.0",
+		},
+		"h2 over tls advertises http3": {
+			config: ServerConfig{LocalCerts: true, HTTP3: true},
+			client: func(t *testing.T, dir string) *http.Client {
+				transport := http.DefaultTransport.(*http.Transport).Clone()
+				transport.TLSClientConfig = &tls.Config{RootCAs: localRoots(t, dir)}
+				return &http.Client{Transport: transport}
+			},
+			scheme:        "https",
+			expectedProto: "HTTP/2.0",
+			expectAltSvc:  true,
+		},
+		"http3": {
+			config: ServerConfig{LocalCerts: true, HTTP3: true},
+			client: func(t *testing.T, dir string) *http.Client {
+				return &http.Client{Transport: &http3.Transport{
+					TLSClientConfig: &tls.Config{RootCAs: localRoots(t, dir)},
+				}}
+			},
+			scheme:        "https",
+			expectedProto: "HTTP/3.0",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			port := freePort(t)
+			dir := t.TempDir()
+			config := tc.config
+			config.Port = port
+			config.CertDir = dir
+			config.ShutdownTimeout = time.Second
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s, err := newServer(ctx, config)
+			require.NoError(t, err)
+			lc := lifecycle.New()
+			s.Register(lc)
+			done := make(chan error, 1)
+			go func() {
+				done <- lc.Run(ctx)
+			}()
+
+			client := tc.client(t, dir)
+			client.Timeout = 5 * time.Second
+
+			var resp *http.Response
+			require.Eventually(t, func() bool {
+				resp, err = client.Get(tc.scheme + "://localhost:" + strconv.Itoa(port) + "/healthz")
+				return err == nil
+			}, 5*time.Second, 50*time.Millisecond)
+			resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.expectedProto, resp.Proto)
+			if tc.expectAltSvc {
+				assert.Equal(t, `h3=":`+strconv.Itoa(port)+`"; ma=2592000`, resp.Header.Get("Alt-Svc"))
+			}
+
+			cancel()
+			assert.ErrorIs(t, <-done, context.Canceled)
+		})
+	}
+}
+
+func TestProtocolValidation(t *testing.T) {
+	tests := map[string]ServerConfig{
+		"h2c with tls":      {Protocol: protocolH2C, LocalCerts: true},
+		"h2 without tls":    {Protocol: protocolH2},
+		"http3 without tls": {HTTP3: true},
+		"unknown protocol":  {Protocol: "spdy"},
+	}
+
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			config.CertDir = t.TempDir()
+			_, err := newServer(context.Background(), config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestH1DoesNotOfferH2(t *testing.T) {
+	// the acme tls config comes with its own protocols
+	srv := &http.Server{TLSConfig: &tls.Config{NextProtos: []string{"h2", "http/1.1", "acme-tls/1"}}}
+	_, err := configureProtocol(ServerConfig{Protocol: protocolH1}, srv)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http/1.1", "acme-tls/1"}, srv.TLSConfig.NextProtos)
+}
+
+func TestHTTP3ClosedWhenHTTPFailsToStart(t *testing.T) {
+	port := freePort(t)
+	taken, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	require.NoError(t, err)
+	defer taken.Close()
+
+	s, err := newServer(context.Background(), ServerConfig{Port: port, LocalCerts: true, HTTP3: true, CertDir: t.TempDir()})
+	require.NoError(t, err)
+	lc := lifecycle.New()
+	s.Register(lc)
+	assert.Error(t, lc.Run(context.Background()))
+
+	// the udp port is freed
+	require.Eventually(t, func() bool {
+		conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+// freePort finds a port that is free for both tcp and udp
+func freePort(t *testing.T) int {
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		conn, err := net.ListenPacket("udp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		if err == nil {
+			conn.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port found")
+	return 0
+}
+
+func localRoots(t *testing.T, dir string) *x509.CertPool {
+	ca, err := readCertificate(filepath.Join(dir, caCertFile))
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return roots
+}
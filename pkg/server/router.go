@@ -2,35 +2,180 @@ package server
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/grindlemire/gothem-stack/pkg/accounts"
+	"github.com/grindlemire/gothem-stack/pkg/apikeys"
 	"github.com/grindlemire/gothem-stack/pkg/auth"
+	"github.com/grindlemire/gothem-stack/pkg/errtrack"
 	"github.com/grindlemire/gothem-stack/pkg/handler"
+	"github.com/grindlemire/gothem-stack/pkg/health"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+	"github.com/grindlemire/gothem-stack/pkg/metrics"
+	"github.com/grindlemire/gothem-stack/pkg/tracing"
 	"github.com/grindlemire/gothem-stack/web"
 
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
-func NewRouter(ctx context.Context) (h http.Handler, err error) {
+// scopeProfileRead lets API keys read who they belong to. Add a scope for every api route group.
+const scopeProfileRead = "profile:read"
+
+// NewRouter builds the echo router. Handlers with external dependencies (databases, queues, etc.)
+// should register readiness checks for them on checks.
+func NewRouter(ctx context.Context, config ServerConfig, checks *health.Registry) (h http.Handler, err error) {
 	e := echo.New()
 
+	// only believe the forwarding headers our own proxies set, otherwise clients pick their ip
+	e.IPExtractor, err = ipExtractor(config.TrustedProxies)
+	if err != nil {
+		return h, err
+	}
+
+	// show the stack, source and request of server errors while developing
+	if config.DevErrorPages && strings.EqualFold(config.Env, "prod") {
+		return h, errors.New("DEV_ERROR_PAGES can't be turned on when ENV=prod")
+	}
+	handler.EnableDevErrorPages(config.DevErrorPages)
+
 	e.Use(
-		// recover from panics and create errors from them
-		middleware.Recover(),
+		// record request metrics. This is outermost so it sees the final status of every request
+		metrics.Middleware(),
+		// continue or start a trace for the request and correlate it with the request logs
+		tracing.Middleware(),
+		// tag the request with an id and store a request scoped logger in the context
+		log.Middleware(),
+		// log a line per request with sampling and slow request detection
+		log.AccessLog(log.AccessLogConfig{
+			SampleRate:    config.AccessLogSampleRate,
+			SlowThreshold: config.SlowRequestThreshold,
+		}),
+		// recover from panics and create errors carrying the stack of the panic from them
+		handler.Recover(),
 		// TODO: other global middleware goes here
 	)
 
+	// register the liveness and readiness probes outside of any auth so orchestrators can reach them
+	checks.RegisterRoutes(e)
+
+	// local accounts live in memory. Implement accounts.Store on your database to keep them.
+	var mailer accounts.Mailer = accounts.LogMailer{}
+	switch {
+	case config.SMTPAddr == "" && config.DevMail:
+		mailer = accounts.LogMailer{Dev: os.Stderr}
+	case config.SMTPAddr == "":
+		zap.S().Warn("SMTP_ADDR isn't set, account emails are logged instead of sent")
+	default:
+		mailer = accounts.SMTPMailer{
+			Addr:     config.SMTPAddr,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+			From:     config.MailFrom,
+		}
+	}
+	accountsService, err := accounts.NewService(accounts.NewMemoryStore(), mailer, accounts.Config{
+		BaseURL:         strings.TrimSuffix(config.BaseURL, "/"),
+		SessionTTL:      config.SessionTTL,
+		MaxFailedLogins: config.LoginMaxFailures,
+		LockoutDuration: config.LoginLockout,
+		PasswordParams:  accounts.DefaultPasswordParams,
+	})
+	if err != nil {
+		return h, err
+	}
+
+	// identify callers by their client certificate, their session or, for the operator pages, the
+	// operator credentials. The first authenticator that finds credentials in a request decides.
+	authenticators := []auth.Authenticator{
+		auth.ClientCerts(),
+		auth.SessionCookie(accounts.SessionCookie, accountsService.Authenticate),
+	}
+	if config.ErrorInboxPassword != "" {
+		authenticators = append(authenticators, auth.Basic("gothem-stack",
+			auth.StaticCredentials(config.ErrorInboxUser, config.ErrorInboxPassword, auth.RoleAdmin),
+		))
+	}
+	authn := auth.NewChain(authenticators...)
+
 	// register the customer pages and components
 	homeHandler, err := handler.NewHomeHandler()
 	if err != nil {
 		return h, err
 	}
 	homeHandler.RegisterRoutes(
-		e.Group("", auth.Middleware()),
+		e.Group("", authn.Middleware(auth.Optional)),
+	)
+
+	// register the sign up, sign in and password reset pages
+	accountsHandler, err := handler.NewAccountsHandler(accountsService, config.SessionTTL, config.OIDC)
+	if err != nil {
+		return h, err
+	}
+	accountsHandler.RegisterRoutes(
+		e.Group("", authn.Middleware(auth.Optional)),
+		authn.Middleware(auth.AnonymousOnly),
 	)
 
+	// register signing in with the OpenID Connect providers. Signing in starts a session like a password.
+	oidc, err := auth.NewOIDC(config.OIDC, &http.Client{Timeout: 10 * time.Second}, accountsHandler.SignIn)
+	if err != nil {
+		return h, err
+	}
+	oidc.RegisterRoutes(e.Group(""))
+
+	// register the page where users create and revoke API keys for their integrations. Keys live
+	// in memory. Implement apikeys.Store on your database to keep them.
+	apiKeys, err := apikeys.NewService(apikeys.NewMemoryStore(), []apikeys.Scope{
+		{Name: scopeProfileRead, Description: "See who the key belongs to"},
+	})
+	if err != nil {
+		return h, err
+	}
+	apiKeysHandler, err := handler.NewAPIKeysHandler(apiKeys)
+	if err != nil {
+		return h, err
+	}
+	apiKeysHandler.RegisterRoutes(
+		e.Group("/settings/api-keys", authn.Middleware(auth.Required)),
+	)
+
+	// register the json api for mobile and command line clients. They authenticate with a client
+	// certificate, an API key or a JWT bearer token, never a session cookie, so pages can't be used
+	// to call it. Every group requires a scope, which limits what API keys can do.
+	// certificate callers are our own services, so they get the api scopes
+	apiAuthenticators := []auth.Authenticator{auth.ClientCerts(scopeProfileRead), apiKeys.Authenticator()}
+	jwtAuthenticator, err := newJWTAuthenticator(config)
+	if err != nil {
+		return h, err
+	}
+	if jwtAuthenticator != nil {
+		apiAuthenticators = append(apiAuthenticators, jwtAuthenticator)
+	}
+	apiHandler, err := handler.NewAPIHandler()
+	if err != nil {
+		return h, err
+	}
+	apiHandler.RegisterRoutes(
+		e.Group("/api", auth.NewChain(apiAuthenticators...).Middleware(auth.Required), auth.RequireScope(scopeProfileRead)),
+	)
+
+	// register the error inbox for admins. It is only served once the operator password is set.
+	if config.ErrorInboxPassword != "" {
+		inboxHandler, err := handler.NewInboxHandler(errtrack.Default())
+		if err != nil {
+			return h, err
+		}
+		inboxHandler.RegisterRoutes(
+			e.Group("/errors", authn.Middleware(auth.Required), auth.RequireRole(auth.RoleAdmin)),
+		)
+	}
+
 	// register the static assets like the favicon and the css
 	err = web.RegisterStaticAssets(e)
 	if err != nil {
@@ -45,3 +190,24 @@ func NewRouter(ctx context.Context) (h http.Handler, err error) {
 
 	return e.Server.Handler, nil
 }
+
+// ipExtractor takes the client ip from X-Forwarded-For, trusting only the proxies in the ranges.
+// Without trusted proxies the ip is the remote address of the connection.
+func ipExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range trustedProxies {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing TRUSTED_PROXIES | cidr=[%s]", cidr)
+		}
+		opts = append(opts, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...), nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPExtractor(t *testing.T) {
+	type tc struct {
+		trustedProxies []string
+		remoteAddr     string
+		forwardedFor   string
+		expectIP       string
+		expectErr      bool
+	}
+
+	tests := map[string]tc{
+		"no trusted proxies ignores the header": {
+			remoteAddr:   "203.0.113.7:1234",
+			forwardedFor: "198.51.100.1",
+			expectIP:     "203.0.113.7",
+		},
+		"trusted proxy": {
+			trustedProxies: []string{"10.0.0.0/8"},
+			remoteAddr:     "10.1.2.3:1234",
+			forwardedFor:   "198.51.100.1",
+			expectIP:       "198.51.100.1",
+		},
+		"client prepending a made up ip": {
+			trustedProxies: []string{"10.0.0.0/8"},
+			remoteAddr:     "10.1.2.3:1234",
+			forwardedFor:   "192.0.2.9, 198.51.100.1",
+			expectIP:       "198.51.100.1",
+		},
+		"untrusted peer": {
+			trustedProxies: []string{"10.0.0.0/8"},
+			remoteAddr:     "203.0.113.7:1234",
+			forwardedFor:   "198.51.100.1",
+			expectIP:       "203.0.113.7",
+		},
+		"invalid range": {
+			trustedProxies: []string{"10.0.0.0"},
+			expectErr:      true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			extract, err := ipExtractor(tc.trustedProxies)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			assert.Equal(t, tc.expectIP, extract(req))
+		})
+	}
+}
+
+func TestNewRouterDevErrorPagesInProd(t *testing.T) {
+	_, err := NewRouter(context.Background(), ServerConfig{Env: "prod", DevErrorPages: true}, nil)
+	assert.EqualError(t, err, "DEV_ERROR_PAGES can't be turned on when ENV=prod")
+}
@@ -2,81 +2,386 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/grindlemire/gothem-stack/pkg/admin"
+	"github.com/grindlemire/gothem-stack/pkg/auth"
+	"github.com/grindlemire/gothem-stack/pkg/health"
+	"github.com/grindlemire/gothem-stack/pkg/lifecycle"
+
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // ServerConfig is configuration for the server parsed from the env.
 type ServerConfig struct {
+	// Env is the environment we run in
+	Env string `envconfig:"ENV"`
+	// DevErrorPages shows browsers the stack, source and request of server errors. It exposes the
+	// internals of the app so it is off unless turned on, `mage run` turns it on while developing.
+	// The server refuses to start with it on when ENV=prod.
+	DevErrorPages bool `envconfig:"DEV_ERROR_PAGES"`
+
 	Port       int  `envconfig:"PORT"              default:"4433"`
 	LocalCerts bool `envconfig:"LOCAL_CERTS"       default:"false" split_words:"true"`
+
+	// CertDir is where the local development CA and the leaf certificates it signs are written. It
+	// defaults to gothem-stack/certs in the user cache dir so the CA key stays out of the repo.
+	CertDir string `envconfig:"CERT_DIR"`
+	// CertHosts are extra hostnames or IPs the local leaf certificate is valid for on top of localhost
+	CertHosts []string `envconfig:"CERT_HOSTS"`
+	// TLSCertFile and TLSKeyFile serve an externally managed certificate. They are reloaded
+	// when the files change on disk.
+	TLSCertFile string `envconfig:"TLS_CERT_FILE"`
+	TLSKeyFile  string `envconfig:"TLS_KEY_FILE"`
+
+	// Protocol is one of h1, h2c or h2. It defaults to h2 with tls and h1 without.
+	Protocol string `envconfig:"PROTOCOL"`
+	// HTTP3 also serves HTTP/3 over QUIC on the same port (udp) and advertises it with Alt-Svc
+	HTTP3 bool `envconfig:"HTTP3"`
+
+	// Admin starts a second listener on AdminAddr with pprof, expvar, build info and runtime log
+	// level control. It binds to localhost by default so it is never exposed publicly by accident.
+	Admin     bool   `envconfig:"ADMIN"`
+	AdminAddr string `envconfig:"ADMIN_ADDR" default:"localhost:6060"`
+
+	// AccessLogSampleRate is the fraction of successful requests written to the access log. Errors
+	// and requests slower than SlowRequestThreshold are always logged.
+	AccessLogSampleRate  float64       `envconfig:"ACCESS_LOG_SAMPLE_RATE" default:"1"`
+	SlowRequestThreshold time.Duration `envconfig:"SLOW_REQUEST_THRESHOLD" default:"1s"`
+	// TrustedProxies are the ip ranges (CIDRs) of the load balancers and proxies in front of us.
+	// The client ip is taken from X-Forwarded-For only as far as these proxies vouch for it,
+	// without them it is the address of the connection so clients can't make up their ip.
+	TrustedProxies []string `envconfig:"TRUSTED_PROXIES"`
+
+	// ErrorInboxPassword is the basic auth password of the ErrorInboxUser operator account, which
+	// has the admin role and can see the captured server errors at /errors. The inbox isn't served
+	// without it.
+	ErrorInboxUser     string `envconfig:"ERROR_INBOX_USER" default:"admin"`
+	ErrorInboxPassword string `envconfig:"ERROR_INBOX_PASSWORD"`
+
+	// BaseURL is the public url of the site. It is used for the links in account emails.
+	BaseURL string `envconfig:"BASE_URL" default:"http://localhost:7331"`
+	// SessionTTL is how long users stay signed in to their local account
+	SessionTTL time.Duration `envconfig:"SESSION_TTL" default:"336h"`
+	// LoginMaxFailures failed sign ins in a row lock an account for LoginLockout
+	LoginMaxFailures int           `envconfig:"LOGIN_MAX_FAILURES" default:"5"`
+	LoginLockout     time.Duration `envconfig:"LOGIN_LOCKOUT" default:"15m"`
+	// SMTPAddr is the host:port of the SMTP server account emails are sent through. Without it
+	// they are written to the log with the tokens of their links redacted, or printed whole to
+	// stderr with DevMail so the links can be followed while developing.
+	SMTPAddr     string `envconfig:"SMTP_ADDR"`
+	SMTPUsername string `envconfig:"SMTP_USERNAME"`
+	SMTPPassword string `envconfig:"SMTP_PASSWORD"`
+	MailFrom     string `envconfig:"MAIL_FROM" default:"no-reply@localhost"`
+	DevMail      bool   `envconfig:"DEV_MAIL"`
+
+	// OIDCProviders are the names of the OpenID Connect providers users can sign in with. Each
+	// is configured with OIDC_<NAME>_* variables, see oidcProviderConfig.
+	OIDCProviders []string            `envconfig:"OIDC_PROVIDERS"`
+	OIDC          []auth.OIDCProvider `ignored:"true"`
+
+	// JWTIssuer enables JWT bearer tokens for the api. Tokens are verified against the keys
+	// published at JWTJWKSURL, or the JWKS document in JWTKeysFile for issuers that don't publish
+	// their keys. JWTRoles maps the values of the JWTRolesClaim to roles, e.g. api-admin:admin, and
+	// is required with it.
+	JWTIssuer     string            `envconfig:"JWT_ISSUER"`
+	JWTAudience   string            `envconfig:"JWT_AUDIENCE"`
+	JWTJWKSURL    string            `envconfig:"JWT_JWKS_URL"`
+	JWTKeysFile   string            `envconfig:"JWT_KEYS_FILE"`
+	JWTAlgorithms []string          `envconfig:"JWT_ALGORITHMS"`
+	JWTRolesClaim string            `envconfig:"JWT_ROLES_CLAIM"`
+	JWTRoles      map[string]string `envconfig:"JWT_ROLES"`
+
+	// ClientCAFile is a pem bundle of CAs trusted to sign client certificates. ClientAuth is one of
+	// none, request, require or verify-if-given. Only certificates verified against the bundle are
+	// turned into a principal by auth.ClientCerts.
+	ClientCAFile string `envconfig:"CLIENT_CA_FILE"`
+	ClientAuth   string `envconfig:"CLIENT_AUTH" default:"none"`
+
+	// ACME enables automatic certificates from an ACME CA such as Let's Encrypt for ACMEDomains.
+	// Certificates are cached in ACMECacheDir so restarts don't hit the CA's rate limits.
+	ACME             bool     `envconfig:"ACME"`
+	ACMEDomains      []string `envconfig:"ACME_DOMAINS"`
+	ACMEDirectoryURL string   `envconfig:"ACME_DIRECTORY_URL" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	ACMECacheDir     string   `envconfig:"ACME_CACHE_DIR" default:"./acme-cache"`
+	ACMEEmail        string   `envconfig:"ACME_EMAIL"`
+	// ACMECARoots is a pem bundle used to trust the ACME directory itself, e.g. a local Pebble server
+	ACMECARoots string `envconfig:"ACME_CA_ROOTS"`
+	// HTTPRedirectPort is the plain http listener used in ACME mode for HTTP-01 challenges and
+	// redirecting to https
+	HTTPRedirectPort int `envconfig:"HTTP_REDIRECT_PORT" default:"80"`
+
+	// ReadinessTimeout bounds how long all the readiness checks may take together
+	ReadinessTimeout time.Duration `envconfig:"READINESS_TIMEOUT" default:"2s"`
+	// DrainPeriod is how long we keep serving with a failing readiness check before shutting
+	// down so load balancers have time to stop routing to us
+	DrainPeriod time.Duration `envconfig:"DRAIN_PERIOD" default:"5s"`
+	// ShutdownTimeout is how long in flight requests have to finish once we stop accepting
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"10s"`
+}
+
+// Server is the public http server. It participates in the process lifecycle through Register.
+type Server struct {
+	config ServerConfig
+	checks *health.Registry
+	http   *http.Server
+	// http3 is only set if HTTP3 is enabled and serves the same handler over QUIC
+	http3 *http3.Server
+	// acme and redirect are only set in ACME mode. The redirect listener answers HTTP-01
+	// challenges and redirects everything else to https.
+	acme     *autocert.Manager
+	redirect *http.Server
+	// admin is the ops listener. It is only set if Admin is enabled.
+	admin *http.Server
 }
 
-// Run runs the server. The context will be cancelled if we receive a SIGTERM (ctrl-c)
-func Run(ctx context.Context) error {
+// New parses the server config from the env and builds the router
+func New(ctx context.Context) (s *Server, err error) {
 	// parse the env config
 	var config ServerConfig
-	err := envconfig.Process("", &config)
+	err = envconfig.Process("", &config)
 	if err != nil {
-		return errors.Wrap(err, "loading environment")
+		return s, errors.Wrap(err, "loading environment")
 	}
-	addr := fmt.Sprintf(":%d", config.Port)
+	config.OIDC, err = loadOIDCProviders(config.OIDCProviders, config.BaseURL)
+	if err != nil {
+		return s, err
+	}
+	return newServer(ctx, config)
+}
 
-	if config.LocalCerts {
-		if !hasCerts() {
-			_, err := generateCerts()
-			if err != nil {
-				return err
-			}
+func newServer(ctx context.Context, config ServerConfig) (s *Server, err error) {
+	var acmeManager *autocert.Manager
+	if config.ACME {
+		acmeManager, err = newACMEManager(config)
+		if err != nil {
+			return s, err
 		}
 	}
 
+	tlsConfig, err := newTLSConfig(config, acmeManager)
+	if err != nil {
+		return s, err
+	}
+
 	// create the top level http router
 	httpRouter := http.NewServeMux()
 
+	// the health registry is shared with the router so handlers can register dependency checks
+	checks := health.NewRegistry(config.ReadinessTimeout)
+
 	// create our echo router and match all routes to it
-	webMux, err := NewRouter(ctx)
+	webMux, err := NewRouter(ctx, config, checks)
 	if err != nil {
-		return err
+		return s, err
 	}
 	httpRouter.Handle("/", webMux)
-	server := &http.Server{Addr: addr, Handler: httpRouter}
 
-	// run the listeners in their own goroutine, this is so we can properly propagate signals
-	// and cleanup everything since there may be other signals that need to be cleaned up.
-	errCh := make(chan error, 1)
-	go func() {
-		zap.S().Infof("started listening on %s", addr)
-		if config.LocalCerts {
-			zap.S().Debug(ctx, "listening with tls")
-			err := server.ListenAndServeTLS(publicKeyFile, privateKeyFile)
-			errCh <- errors.Wrap(err, "starting server")
-			return
+	s = &Server{
+		config: config,
+		checks: checks,
+		http: &http.Server{
+			Addr:      fmt.Sprintf(":%d", config.Port),
+			Handler:   httpRouter,
+			TLSConfig: tlsConfig,
+		},
+	}
+
+	if config.Admin {
+		s.admin = &http.Server{
+			Addr:    config.AdminAddr,
+			Handler: admin.NewHandler(),
 		}
-		err := server.ListenAndServe()
-		errCh <- errors.Wrap(err, "starting server")
-	}()
+	}
+
+	s.http3, err = configureProtocol(config, s.http)
+	if err != nil {
+		return s, err
+	}
+
+	if acmeManager != nil {
+		s.acme = acmeManager
+		s.redirect = &http.Server{
+			Addr:    fmt.Sprintf(":%d", config.HTTPRedirectPort),
+			Handler: acmeManager.HTTPHandler(redirectHandler(config.Port)),
+		}
+	}
+	return s, nil
+}
+
+// newTLSConfig builds the tls config for the configured certificate source. It returns nil if the
+// server should serve plain http.
+func newTLSConfig(config ServerConfig, acmeManager *autocert.Manager) (tlsConfig *tls.Config, err error) {
+	clientAuth, err := parseClientAuth(config.ClientAuth)
+	if err != nil {
+		return tlsConfig, err
+	}
 
-	// wait for either the context to be cancelled indicating we should shutdown
-	// or for the servers to fail
-	for {
-		select {
-		case <-ctx.Done():
-			shutdownCTX, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-
-			err = server.Shutdown(shutdownCTX)
-			if err != nil {
-				return err
+	var certs *certLoader
+	switch {
+	case acmeManager != nil:
+		// the acme tls config also answers TLS-ALPN-01 challenges
+		tlsConfig = acmeManager.TLSConfig()
+	case config.TLSCertFile != "" || config.TLSKeyFile != "":
+		certs, err = newFileCertLoader(config.TLSCertFile, config.TLSKeyFile)
+	case config.LocalCerts:
+		certs, err = newLocalCertLoader(config.CertDir, config.CertHosts)
+	default:
+		if clientAuth != tls.NoClientCert {
+			return tlsConfig, errors.New("CLIENT_AUTH requires tls to be enabled")
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return tlsConfig, err
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	}
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	if clientAuth != tls.NoClientCert {
+		if config.ClientCAFile == "" {
+			return tlsConfig, errors.New("CLIENT_CA_FILE is required when CLIENT_AUTH is set")
+		}
+		caPEM, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return tlsConfig, errors.Wrap(err, "reading client ca file")
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return tlsConfig, errors.Errorf("no certificates found in %s", config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = clientAuth
+	}
+	return tlsConfig, nil
+}
+
+// parseClientAuth maps the CLIENT_AUTH modes to the tls client auth policy. "require" always
+// verifies the certificate since an unverified certificate can't be used to authenticate.
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(mode) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	default:
+		return tls.NoClientCert, errors.Errorf("unknown client auth mode %q", mode)
+	}
+}
+
+// Register adds the server's listeners to the lifecycle. The admin listener starts first and
+// stops last so it stays available while we drain. The redirect listener starts before the https
+// listener so ACME challenges can be answered as soon as it starts requesting certificates.
+func (s *Server) Register(lc *lifecycle.Manager) {
+	if s.admin != nil {
+		lc.Append(lifecycle.Hook{
+			Name: "admin",
+			OnStart: func(ctx context.Context) error {
+				return serve(lc, "admin", s.admin)
+			},
+			OnStop:      s.admin.Shutdown,
+			StopTimeout: s.config.ShutdownTimeout,
+		})
+	}
+
+	if s.redirect != nil {
+		lc.Append(lifecycle.Hook{
+			Name: "http-redirect",
+			OnStart: func(ctx context.Context) error {
+				return serve(lc, "http-redirect", s.redirect)
+			},
+			OnStop:      s.redirect.Shutdown,
+			StopTimeout: s.config.ShutdownTimeout,
+		})
+	}
+
+	// The stop deadline covers both the drain period and the time given to in flight requests.
+	lc.Append(lifecycle.Hook{
+		Name: "http",
+		OnStart: func(ctx context.Context) error {
+			if s.http3 != nil {
+				err := serveHTTP3(lc, "http3", s.http3)
+				if err != nil {
+					return err
+				}
+			}
+			err := serve(lc, "http", s.http)
+			if err != nil && s.http3 != nil {
+				// a hook that fails to start isn't stopped, so close the quic listener ourselves
+				_ = s.http3.Close()
 			}
-			return ctx.Err()
-		case err := <-errCh:
 			return err
+		},
+		OnStop:      s.stop,
+		StopTimeout: s.config.DrainPeriod + s.config.ShutdownTimeout,
+	})
+}
+
+// serve binds the listener so address errors surface immediately and then serves in the background
+func serve(lc *lifecycle.Manager, name string, srv *http.Server) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "listening on %s", srv.Addr)
+	}
+
+	go func() {
+		var err error
+		zap.S().Infof("%s started listening on %s", name, srv.Addr)
+		if srv.TLSConfig != nil {
+			zap.S().Debugf("%s listening with tls", name)
+			// the certificates come from TLSConfig.GetCertificate so no files are passed here
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
 		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			lc.Fail(name, errors.Wrap(err, "serving http"))
+		}
+	}()
+	return nil
+}
+
+// stop fails readiness and keeps serving for the drain period so load balancers stop sending us
+// new requests, then gives in flight requests the shutdown timeout to finish
+func (s *Server) stop(ctx context.Context) error {
+	s.checks.Drain()
+	zap.S().Infof("draining for %s before shutting down", s.config.DrainPeriod)
+	select {
+	case <-time.After(s.config.DrainPeriod):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	shutdownCTX, cancel := context.WithTimeout(ctx, s.config.ShutdownTimeout)
+	defer cancel()
+
+	// shut the tcp and quic listeners down together so they share the shutdown timeout
+	h3Err := make(chan error, 1)
+	go func() {
+		h3Err <- shutdownHTTP3(shutdownCTX, s.http3)
+	}()
+
+	err := s.http.Shutdown(shutdownCTX)
+	if err != nil {
+		return errors.Wrap(err, "shutting down http server")
 	}
+	return <-h3Err
 }
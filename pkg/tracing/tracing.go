@@ -0,0 +1,175 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+	"github.com/grindlemire/gothem-stack/pkg/lifecycle"
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/a-h/templ"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// instrumentationName identifies the spans created by this repo
+const instrumentationName = "github.com/grindlemire/gothem-stack"
+
+// Config is configuration for tracing parsed from the env
+type Config struct {
+	// Endpoint is the OTLP/HTTP collector url, e.g. http://localhost:4318. Spans are only
+	// exported if it is set, but trace context is always propagated.
+	Endpoint    string  `envconfig:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ServiceName string  `envconfig:"OTEL_SERVICE_NAME" default:"gothem-stack"`
+	SampleRatio float64 `envconfig:"TRACING_SAMPLE_RATIO" default:"1"`
+}
+
+// Provider owns the global tracer provider so spans can be flushed on shutdown
+type Provider struct {
+	tp *sdktrace.TracerProvider
+}
+
+// New parses the tracing config from the env and installs the global tracer provider
+func New(ctx context.Context) (p *Provider, err error) {
+	var config Config
+	err = envconfig.Process("", &config)
+	if err != nil {
+		return p, errors.Wrap(err, "loading tracing environment")
+	}
+
+	var exporter sdktrace.SpanExporter
+	if config.Endpoint != "" {
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.Endpoint))
+		if err != nil {
+			return p, errors.Wrap(err, "creating otlp exporter")
+		}
+		zap.S().Infof("exporting traces to %s", config.Endpoint)
+	}
+
+	return NewWithExporter(config, exporter)
+}
+
+// NewWithExporter installs a global tracer provider that exports to the exporter. A nil exporter
+// creates spans without exporting them. Tests can pass an in memory exporter
+// (go.opentelemetry.io/otel/sdk/trace/tracetest).
+func NewWithExporter(config Config, exporter sdktrace.SpanExporter) (p *Provider, err error) {
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", config.ServiceName)),
+	)
+	if err != nil {
+		return p, errors.Wrap(err, "creating tracing resource")
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		// respect the sampling decision of the caller so a trace is either complete or missing
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	}
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	// W3C traceparent and baggage
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return &Provider{tp: tp}, nil
+}
+
+// Register adds the provider to the lifecycle. Register it before the servers so it stops after
+// them and the spans of the last requests are flushed.
+func (p *Provider) Register(lc *lifecycle.Manager) {
+	lc.Append(lifecycle.Hook{
+		Name: "tracing",
+		OnStop: func(ctx context.Context) error {
+			return errors.Wrap(p.tp.Shutdown(ctx), "flushing spans")
+		},
+	})
+}
+
+// ForceFlush exports every finished span that hasn't been exported yet
+func (p *Provider) ForceFlush(ctx context.Context) error {
+	return p.tp.ForceFlush(ctx)
+}
+
+// Start starts a span named name as a child of the span in ctx
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// Middleware continues the trace from the W3C traceparent header (or starts a new one) and
+// creates a server span for the request named after the echo route template. The trace and
+// span ids are added to the request logger so every log line for the request carries them.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+			route := c.Path()
+			ctx, span := Start(ctx, req.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", req.Method),
+					attribute.String("http.route", route),
+					attribute.String("url.path", req.URL.Path),
+					attribute.String("client.address", c.RealIP()),
+					attribute.Bool("htmx.request", req.Header.Get("HX-Request") == "true"),
+				),
+			)
+			defer span.End()
+
+			ctx = log.NewContext(ctx, log.FromContext(ctx).With(log.TraceFields(ctx)...))
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			status := c.Response().Status
+			if err != nil {
+				span.RecordError(err)
+				if !c.Response().Committed {
+					// the error handler responds once the error is returned to echo, record the status it sends
+					status = apperr.HTTPStatus(err)
+				}
+			}
+
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			return err
+		}
+	}
+}
+
+// Component wraps a templ component so rendering it creates a span. Use it for expensive
+// components inside a page, e.g. @tracing.Component("dashboard.chart", chart(data)).
+func Component(name string, component templ.Component) templ.Component {
+	return templ.ComponentFunc(func(ctx context.Context, w io.Writer) error {
+		ctx, span := Start(ctx, "templ "+name)
+		defer span.End()
+
+		err := component.Render(ctx, w)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	})
+}
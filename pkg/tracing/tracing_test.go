@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grindlemire/gothem-stack/pkg/log"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMiddleware(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	p, err := NewWithExporter(Config{ServiceName: "test", SampleRatio: 1}, exporter)
+	require.NoError(t, err)
+
+	core, logs := observer.New(zap.DebugLevel)
+	restore := zap.ReplaceGlobals(zap.New(core))
+	defer restore()
+
+	e := echo.New()
+	e.Use(Middleware())
+	e.GET("/users/:id", func(c echo.Context) error {
+		ctx, span := Start(c.Request().Context(), "child")
+		defer span.End()
+		log.FromContext(ctx).Info("handling request")
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.ErrServiceUnavailable
+	})
+
+	type tc struct {
+		path          string
+		traceparent   string
+		expectedSpan  string
+		expectedTrace string
+		expectError   bool
+	}
+
+	tests := map[string]tc{
+		"continues the incoming trace": {
+			path:          "/users/123",
+			traceparent:   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			expectedSpan:  "GET /users/:id",
+			expectedTrace: "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		"starts a new trace": {
+			path:         "/users/123",
+			expectedSpan: "GET /users/:id",
+		},
+		"records server errors": {
+			path:         "/fail",
+			expectedSpan: "GET /fail",
+			expectError:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			exporter.Reset()
+			logs.TakeAll()
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.traceparent != "" {
+				req.Header.Set("traceparent", tc.traceparent)
+			}
+			e.ServeHTTP(httptest.NewRecorder(), req)
+			require.NoError(t, p.ForceFlush(context.Background()))
+
+			var server *tracetest.SpanStub
+			spans := exporter.GetSpans()
+			for i := range spans {
+				if spans[i].SpanKind == trace.SpanKindServer {
+					server = &spans[i]
+				}
+			}
+			require.NotNil(t, server)
+			assert.Equal(t, tc.expectedSpan, server.Name)
+			if tc.expectedTrace != "" {
+				assert.Equal(t, tc.expectedTrace, server.SpanContext.TraceID().String())
+			}
+			if tc.expectError {
+				assert.NotEmpty(t, server.Events)
+				assert.Contains(t, server.Attributes, attribute.Int("http.response.status_code", http.StatusServiceUnavailable))
+				assert.Equal(t, codes.Error, server.Status.Code)
+				return
+			}
+
+			// the log line from the handler carries the trace id
+			entries := logs.FilterMessage("handling request").All()
+			require.Len(t, entries, 1)
+			assert.Equal(t, server.SpanContext.TraceID().String(), entries[0].ContextMap()["trace_id"])
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package accounts
+
+import (
+	"net/url"
+
+	"github.com/grindlemire/gothem-stack/pkg/apperr"
+)
+
+// Form is a submitted form with what was wrong with it, so it can be rendered again with the
+// values kept and the errors next to their fields
+type Form struct {
+	Values url.Values
+	// Error is shown above the form, e.g. wrong email or password
+	Error  string
+	Fields map[string]string
+}
+
+// NewForm creates a form for the submitted values. err may be nil for an empty form.
+func NewForm(values url.Values, err *apperr.Error) Form {
+	f := Form{Values: values, Fields: map[string]string{}}
+	if err == nil {
+		return f
+	}
+	for _, fe := range err.Fields {
+		f.Fields[fe.Field] = fe.Message
+	}
+	f.Error = err.Message
+	return f
+}
+
+// Value is the submitted value of the field. Password inputs don't use it so passwords are
+// never sent back.
+func (f Form) Value(field string) string {
+	if f.Values == nil {
+		return ""
+	}
+	return f.Values.Get(field)
+}
+
+// FieldError is the problem with the field, if any
+func (f Form) FieldError(field string) string {
+	return f.Fields[field]
+}
+
+// Provider is an identity provider users can sign in with instead of a password
+type Provider struct {
+	Label string
+	URL   string
+}
@@ -0,0 +1,57 @@
+package apikeys
+
+import (
+	"time"
+
+	"github.com/grindlemire/gothem-stack/pkg/apikeys"
+	"github.com/grindlemire/gothem-stack/web/pages/accounts"
+)
+
+// View is everything on the API keys page that changes when keys are created or revoked
+type View struct {
+	Keys   []apikeys.Key
+	Scopes []apikeys.Scope
+	// Form is the create form, with its errors if creating a key failed
+	Form accounts.Form
+	// Created is the key that was just created. It is only ever shown this once.
+	Created string
+	Now     time.Time
+}
+
+// Expiry is a choice of when a new key expires
+type Expiry struct {
+	Label string
+	Days  int
+}
+
+// Expiries are the choices of when a new key expires. 0 days never expires.
+var Expiries = []Expiry{
+	{Label: "In 30 days", Days: 30},
+	{Label: "In 90 days", Days: 90},
+	{Label: "In a year", Days: 365},
+	{Label: "Never", Days: 0},
+}
+
+// checked reports whether the scope was picked in the submitted form
+func (v View) checked(scope string) bool {
+	if v.Form.Values == nil {
+		return false
+	}
+	for _, s := range v.Form.Values["scopes"] {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// status is how the key stands, e.g. active or revoked
+func (v View) status(k apikeys.Key) string {
+	switch {
+	case k.Revoked():
+		return "revoked"
+	case k.Expired(v.Now):
+		return "expired"
+	}
+	return "active"
+}
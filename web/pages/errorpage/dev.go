@@ -0,0 +1,39 @@
+package errorpage
+
+// DevError is everything the developer error page shows about a failed request
+type DevError struct {
+	Status  int
+	Message string
+	Method  string
+	URL     string
+	// Route is the echo route template that matched the request
+	Route string
+	// Chain is the message of each wrap layer, outermost first
+	Chain   []string
+	Frames  []DevFrame
+	Params  []KeyValue
+	Headers []KeyValue
+}
+
+// DevFrame is a stack frame with the source around it
+type DevFrame struct {
+	Func string
+	File string
+	Line int
+	// Library frames (the standard library and dependencies) are collapsed by default
+	Library bool
+	Source  []SourceLine
+}
+
+// SourceLine is a line of a source snippet
+type SourceLine struct {
+	Number  int
+	Text    string
+	Current bool
+}
+
+// KeyValue is a single request header or parameter
+type KeyValue struct {
+	Key   string
+	Value string
+}